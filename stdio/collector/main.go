@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"math"
@@ -14,6 +16,10 @@ const (
 )
 
 func main() {
+	var printJSON bool
+	flag.BoolVar(&printJSON, "json", false, "print the summary as JSON after the final stats")
+	flag.Parse()
+
 	// create scanner on top of stdin
 	scanner := bufio.NewScanner(os.Stdin)
 	if err := scanner.Err(); err != nil {
@@ -26,6 +32,10 @@ func main() {
 	counter := 0
 	rangeChanged := false
 
+	// streaming estimators keep the memory bounded however many metrics come
+	var variance welford
+	percentiles := newQuantiles(0.5, 0.9, 0.95, 0.99)
+
 	// handler scanner error
 	if err := scanner.Err(); err != nil {
 		fmt.Fprintln(os.Stderr, "reading standard input:", err)
@@ -49,6 +59,8 @@ func main() {
 		}
 		counter++
 		sum += metric
+		variance.add(float64(metric))
+		percentiles.add(float64(metric))
 
 		if rangeChanged { //   update range and print if changed
 			fmt.Fprintf(os.Stdout, "New range: [%d:%d]\n", min, max)
@@ -57,6 +69,25 @@ func main() {
 	}
 
 	// print final stats
-	fmt.Fprintf(os.Stdout, "Stats: metrics collected: %d in range [%d:%d] with avg: %s\n", counter, min, max, fmt.Sprintf("%.2f", float64(sum)/float64(counter)))
+	fmt.Fprintf(os.Stdout, "Stats: metrics collected: %d in range [%d:%d] with avg: %s, stddev: %.2f, median: %.2f, p90: %.2f, p95: %.2f, p99: %.2f\n",
+		counter, min, max, fmt.Sprintf("%.2f", float64(sum)/float64(counter)),
+		variance.stddev(), percentiles.value(0), percentiles.value(1), percentiles.value(2), percentiles.value(3))
 
+	if printJSON {
+		s := summary{
+			Count:  counter,
+			StdDev: variance.stddev(),
+			Median: percentiles.value(0),
+			P90:    percentiles.value(1),
+			P95:    percentiles.value(2),
+			P99:    percentiles.value(3),
+		}
+		// min, max and avg are not set if there are no metrics
+		if counter > 0 {
+			s.Min, s.Max, s.Avg = min, max, float64(sum)/float64(counter)
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(s); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
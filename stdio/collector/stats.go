@@ -0,0 +1,175 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// welford computes the mean and the standard deviation in a single pass without keeping the values
+// (https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Welford's_online_algorithm)
+type welford struct {
+	n    int
+	mean float64
+	// m2 is the sum of squared differences from the current mean
+	m2 float64
+}
+
+func (w *welford) add(x float64) {
+	w.n++
+	d := x - w.mean
+	w.mean += d / float64(w.n)
+	w.m2 += d * (x - w.mean)
+}
+
+// stddev returns the sample standard deviation, it is 0 for less than 2 values
+func (w *welford) stddev() float64 {
+	if w.n < 2 {
+		return 0
+	}
+	return math.Sqrt(w.m2 / float64(w.n-1))
+}
+
+// exactLimit is the amount of values kept to compute exact quantiles, the P² estimators start from them afterwards
+const exactLimit = 1000
+
+// quantiles computes several quantiles at once. Until exactLimit values come they are kept and the quantiles are
+// exact, then every quantile is estimated by P², so the memory does not depend on the amount of values.
+type quantiles struct {
+	ps         []float64
+	values     []float64
+	estimators []*p2Quantile
+}
+
+func newQuantiles(ps ...float64) *quantiles {
+	return &quantiles{ps: ps, values: make([]float64, 0, exactLimit)}
+}
+
+func (q *quantiles) add(x float64) {
+	if q.estimators != nil {
+		for _, e := range q.estimators {
+			e.add(x)
+		}
+		return
+	}
+
+	q.values = append(q.values, x)
+	if len(q.values) < exactLimit {
+		return
+	}
+	sort.Float64s(q.values)
+	for _, p := range q.ps {
+		q.estimators = append(q.estimators, newP2Quantile(p, q.values))
+	}
+	q.values = nil
+}
+
+// value returns the i-th quantile
+func (q *quantiles) value(i int) float64 {
+	if q.estimators != nil {
+		return q.estimators[i].value()
+	}
+	if len(q.values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), q.values...)
+	sort.Float64s(sorted)
+	return exactQuantile(sorted, q.ps[i])
+}
+
+// exactQuantile interpolates between the closest ranks like P² markers do: the p-quantile is at the rank 1+(n-1)p
+func exactQuantile(sorted []float64, p float64) float64 {
+	h := float64(len(sorted)-1) * p
+	lo := int(h)
+	if lo+1 >= len(sorted) {
+		return sorted[lo]
+	}
+	return sorted[lo] + (h-float64(lo))*(sorted[lo+1]-sorted[lo])
+}
+
+// p2Quantile estimates the p-quantile with the P² algorithm (Jain & Chlamtac, 1985) keeping only 5 markers:
+// the minimum, the p/2, p and (1+p)/2 quantiles and the maximum. Their heights are adjusted with a parabolic
+// formula as the values come.
+type p2Quantile struct {
+	// heights, actual positions (1-based), desired positions and desired position increments of the markers
+	q    [5]float64
+	pos  [5]float64
+	want [5]float64
+	inc  [5]float64
+}
+
+// newP2Quantile places the markers at their ranks in the sorted values, there must be enough values
+// for the ranks to differ
+func newP2Quantile(p float64, sorted []float64) *p2Quantile {
+	e := &p2Quantile{inc: [5]float64{0, p / 2, p, (1 + p) / 2, 1}}
+	n := float64(len(sorted))
+	for i, f := range e.inc {
+		e.want[i] = 1 + (n-1)*f
+		e.pos[i] = math.Round(e.want[i])
+		e.q[i] = sorted[int(e.pos[i])-1]
+	}
+	return e
+}
+
+func (e *p2Quantile) add(x float64) {
+	// find the cell of the value and move the extreme markers if needed
+	var k int
+	switch {
+	case x < e.q[0]:
+		e.q[0] = x
+		k = 0
+	case x >= e.q[4]:
+		e.q[4] = x
+		k = 3
+	default:
+		for k = 0; x >= e.q[k+1]; k++ {
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		e.pos[i]++
+	}
+	for i := range e.want {
+		e.want[i] += e.inc[i]
+	}
+
+	// move the middle markers which are off their desired positions by one
+	for i := 1; i <= 3; i++ {
+		d := e.want[i] - e.pos[i]
+		if d >= 1 && e.pos[i+1]-e.pos[i] > 1 || d <= -1 && e.pos[i-1]-e.pos[i] < -1 {
+			sign := math.Copysign(1, d)
+			q := e.parabolic(i, sign)
+			if e.q[i-1] >= q || q >= e.q[i+1] {
+				q = e.linear(i, sign)
+			}
+			e.q[i] = q
+			e.pos[i] += sign
+		}
+	}
+}
+
+func (e *p2Quantile) parabolic(i int, d float64) float64 {
+	return e.q[i] + d/(e.pos[i+1]-e.pos[i-1])*
+		((e.pos[i]-e.pos[i-1]+d)*(e.q[i+1]-e.q[i])/(e.pos[i+1]-e.pos[i])+
+			(e.pos[i+1]-e.pos[i]-d)*(e.q[i]-e.q[i-1])/(e.pos[i]-e.pos[i-1]))
+}
+
+func (e *p2Quantile) linear(i int, d float64) float64 {
+	j := i + int(d)
+	return e.q[i] + d*(e.q[j]-e.q[i])/(e.pos[j]-e.pos[i])
+}
+
+func (e *p2Quantile) value() float64 {
+	return e.q[2]
+}
+
+// summary is the JSON summary of the collected metrics
+type summary struct {
+	Count  int     `json:"count"`
+	Min    int     `json:"min"`
+	Max    int     `json:"max"`
+	Avg    float64 `json:"avg"`
+	StdDev float64 `json:"stddev"`
+	Median float64 `json:"median"`
+	P90    float64 `json:"p90"`
+	P95    float64 `json:"p95"`
+	P99    float64 `json:"p99"`
+}
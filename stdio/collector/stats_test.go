@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func Test_welford(t *testing.T) {
+	tests := []struct {
+		values     []float64
+		wantMean   float64
+		wantStdDev float64
+	}{
+		{nil, 0, 0},
+		{[]float64{5}, 5, 0},
+		{[]float64{2, 4, 4, 4, 5, 5, 7, 9}, 5, math.Sqrt(32.0 / 7)},
+		// the large offset would lose the precision with the sum of squares
+		{[]float64{1e9 + 4, 1e9 + 7, 1e9 + 13, 1e9 + 16}, 1e9 + 10, math.Sqrt(30)},
+	}
+
+	for _, tt := range tests {
+		var w welford
+		for _, x := range tt.values {
+			w.add(x)
+		}
+		if math.Abs(w.mean-tt.wantMean) > 1e-9 || math.Abs(w.stddev()-tt.wantStdDev) > 1e-9 {
+			t.Errorf("%v: mean %v, stddev %v, want %v, %v", tt.values, w.mean, w.stddev(), tt.wantMean, tt.wantStdDev)
+		}
+	}
+}
+
+func Test_exactQuantile(t *testing.T) {
+	sorted := make([]float64, 100)
+	for i := range sorted {
+		sorted[i] = float64(i + 1)
+	}
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{0, 1},
+		{0.5, 50.5},
+		{0.9, 90.1},
+		{0.99, 99.01},
+		{1, 100},
+	}
+
+	for _, tt := range tests {
+		if got := exactQuantile(sorted, tt.p); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("exactQuantile(1..100, %v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
+
+func Test_quantiles(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	uniform := func() float64 { return r.Float64() * 1000 }
+	normal := func() float64 { return 500 + 100*r.NormFloat64() }
+
+	tests := []struct {
+		name string
+		n    int
+		gen  func() float64
+		// tolerance is the allowed error relative to the exact quantile, the quantiles are exact below exactLimit
+		tolerance float64
+	}{
+		{"few", 10, uniform, 1e-9},
+		{"below the limit", exactLimit - 1, uniform, 1e-9},
+		{"at the limit", exactLimit, uniform, 0.01},
+		{"uniform", 100000, uniform, 0.01},
+		{"normal", 100000, normal, 0.01},
+	}
+
+	ps := []float64{0.5, 0.9, 0.95, 0.99}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQuantiles(ps...)
+			values := make([]float64, tt.n)
+			for i := range values {
+				values[i] = tt.gen()
+				q.add(values[i])
+			}
+			sort.Float64s(values)
+
+			for i, p := range ps {
+				want := exactQuantile(values, p)
+				if got := q.value(i); math.Abs(got-want) > tt.tolerance*want {
+					t.Errorf("quantile %v = %v, want %v", p, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var stderrModes = []string{"stream", "merge"}
+
+// result is the outcome of a single run of the command
+type result struct {
+	output []byte
+	// err is nil if the command exited with zero status, *exec.ExitError if it exited with non-zero status
+	// or any other error if it could not be started
+	err error
+	// timeout is set if the command was stopped because it ran longer than it
+	timeout  time.Duration
+	start    time.Time
+	duration time.Duration
+}
+
+func (r result) failed() bool {
+	return r.err != nil
+}
+
+// exitCode returns the exit status of the command or -1 if it was killed by a signal or could not be started
+func (r result) exitCode() int {
+	var exitErr *exec.ExitError
+	switch {
+	case r.err == nil:
+		return 0
+	case errors.As(r.err, &exitErr):
+		return exitErr.ExitCode()
+	default:
+		return -1
+	}
+}
+
+// status describes how the command exited, e.g. "exit 0", "exit 2", "signal: killed" or why it could not be started
+func (r result) status() string {
+	var exitErr *exec.ExitError
+	switch {
+	case r.timeout > 0:
+		return fmt.Sprintf("timeout %s", r.timeout)
+	case r.err == nil:
+		return "exit 0"
+	case errors.As(r.err, &exitErr) && exitErr.ExitCode() >= 0:
+		return fmt.Sprintf("exit %d", exitErr.ExitCode())
+	case errors.As(r.err, &exitErr):
+		return exitErr.String()
+	default:
+		return r.err.Error()
+	}
+}
+
+// commandLine is the command with its arguments as it is shown in the header and passed to the shell
+func commandLine(cfg config) string {
+	return strings.Join(append([]string{cfg.cmd}, cfg.args...), " ")
+}
+
+// runCmd runs the command once and captures its stdout.
+// stderr is either passed through to stderr of watchcmd or merged into the captured output.
+// If lines is not nil, it is called with every line of the captured output as soon as the line is written.
+//
+// The command runs in its own process group. When ctx is cancelled or the run takes longer than cfg.timeout,
+// the group receives SIGTERM and SIGKILL if it is still running cfg.grace later.
+func runCmd(ctx context.Context, cfg config, lines func(line []byte)) result {
+	runCtx := ctx
+	if cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, cfg.timeout)
+		defer cancel()
+	}
+
+	c := exec.CommandContext(runCtx, cfg.cmd, cfg.args...)
+	if cfg.shell {
+		c = exec.CommandContext(runCtx, "sh", "-c", commandLine(cfg))
+	}
+
+	setProcessGroup(c)
+	var kill *time.Timer
+	c.Cancel = func() error {
+		kill = time.AfterFunc(cfg.grace, func() { killGroup(c) })
+		return terminateGroup(c)
+	}
+	// the pipes are closed if the process or its children still hold them after the grace period
+	c.WaitDelay = cfg.grace
+
+	var out bytes.Buffer
+	var stdout io.Writer = &out
+	if lines != nil {
+		stream := &lineWriter{fn: lines}
+		defer stream.flush()
+		stdout = io.MultiWriter(&out, stream)
+	}
+	c.Stdout = stdout
+	c.Stderr = os.Stderr
+	if cfg.name != "" {
+		// stderr of a job is prefixed with its name like the output
+		stderr := newPrefixWriter(os.Stderr, cfg.name)
+		defer stderr.flush()
+		c.Stderr = stderr
+	}
+	if cfg.stderr == "merge" {
+		c.Stderr = stdout
+	}
+
+	start := time.Now()
+	err := c.Run()
+	if kill != nil {
+		kill.Stop()
+	}
+
+	res := result{output: out.Bytes(), err: err, start: start, duration: time.Since(start)}
+	if ctx.Err() == nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		res.timeout = cfg.timeout
+	}
+	return res
+}
+
+// lineWriter calls fn for every complete line written to it without the line break,
+// the incomplete line at the end is passed on flush. The line is only valid during the call.
+type lineWriter struct {
+	fn      func(line []byte)
+	partial []byte
+}
+
+func (lw *lineWriter) Write(b []byte) (int, error) {
+	lw.partial = append(lw.partial, b...)
+	rest := lw.partial
+	for {
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			break
+		}
+		lw.fn(rest[:end])
+		rest = rest[end+1:]
+	}
+	lw.partial = append(lw.partial[:0], rest...)
+	return len(b), nil
+}
+
+func (lw *lineWriter) flush() {
+	if len(lw.partial) > 0 {
+		lw.fn(lw.partial)
+		lw.partial = lw.partial[:0]
+	}
+}
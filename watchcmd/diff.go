@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// diffContext is the amount of unchanged lines shown around the changes
+const diffContext = 3
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// diffLines writes the difference between two outputs in the unified format
+func diffLines(w io.Writer, from, to string) error {
+	fromLines, toLines := splitLines(from), splitLines(to)
+	ops, ok := lineDiff(fromLines, toLines)
+	if !ok {
+		_, err := fmt.Fprintf(w, "outputs differ in more than %d lines, %d lines and %d lines\n", diffMaxEdits, len(fromLines), len(toLines))
+		return err
+	}
+
+	// line numbers of the first op in both outputs, for the hunk headers
+	fromLine, toLine := 1, 1
+	for start := 0; start < len(ops); {
+		// find the next change and the hunk around it
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		hunkStart := first - diffContext
+		if hunkStart < start {
+			hunkStart = start
+		}
+		fromLine, toLine = advance(ops[start:hunkStart], fromLine, toLine)
+
+		// the hunk ends when there are more than two contexts of unchanged lines
+		end, unchanged := first, 0
+		for end < len(ops) && unchanged <= 2*diffContext {
+			if ops[end].kind == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+			end++
+		}
+		hunkEnd := end - unchanged + diffContext
+		if hunkEnd > len(ops) {
+			hunkEnd = len(ops)
+		}
+
+		hunk := ops[hunkStart:hunkEnd]
+		fromCount, toCount := count(hunk)
+		if _, err := fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", hunkLine(fromLine, fromCount), fromCount, hunkLine(toLine, toCount), toCount); err != nil {
+			return err
+		}
+		for _, op := range hunk {
+			if _, err := fmt.Fprintf(w, "%c%s\n", op.kind, op.line); err != nil {
+				return err
+			}
+		}
+
+		fromLine, toLine = advance(hunk, fromLine, toLine)
+		start = hunkEnd
+	}
+	return nil
+}
+
+// hunkLine is the line number of the hunk header, an empty range is denoted by the line before it like in GNU diff
+func hunkLine(line, count int) int {
+	if count == 0 {
+		return line - 1
+	}
+	return line
+}
+
+// diffMaxEdits is the largest amount of removed and added lines lineDiff looks for, the search takes
+// memory quadratic in it
+const diffMaxEdits = 1000
+
+// lineDiff finds the shortest edit script turning a into b with the algorithm of Myers
+// (http://www.xmailserver.org/diff2.pdf). It gives up if more than diffMaxEdits lines are removed or added.
+func lineDiff(a, b []string) ([]diffOp, bool) {
+	// the common prefix and suffix are not searched
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits, ok := shortestEdit(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	if !ok {
+		return nil, false
+	}
+
+	ops := make([]diffOp, 0, prefix+len(edits)+suffix)
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, edits...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops, true
+}
+
+// shortestEdit is the greedy search of Myers. v[k] is the furthest x reached on the diagonal k = x - y,
+// trace[d] keeps v[-d..d] after d edits to walk the path back.
+func shortestEdit(a, b []string) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	maxEdits := n + m
+	if maxEdits > diffMaxEdits {
+		maxEdits = diffMaxEdits
+	}
+
+	offset := maxEdits + 1
+	v := make([]int, 2*maxEdits+3)
+	var trace [][]int
+	for d := 0; d <= maxEdits; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				// down: a line of b is added
+				x = v[offset+k+1]
+			} else {
+				// right: a line of a is removed
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+				return backtrack(a, b, trace), true
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+	return nil, false
+}
+
+// backtrack walks the path found by shortestEdit from the end to the start
+func backtrack(a, b []string, trace [][]int) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		// prev holds v[-(d-1)..d-1]
+		prev := trace[d-1]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			prevK = k + 1
+		}
+		prevX := prev[prevK+d-1]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for ; x > 0; x-- {
+		ops = append(ops, diffOp{' ', a[x-1]})
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	removedFirst(ops)
+	return ops
+}
+
+// removedFirst puts the removed lines of every change before the added ones, like diff -u does
+func removedFirst(ops []diffOp) {
+	for start := 0; start < len(ops); {
+		if ops[start].kind == ' ' {
+			start++
+			continue
+		}
+		end := start
+		for end < len(ops) && ops[end].kind != ' ' {
+			end++
+		}
+		sort.SliceStable(ops[start:end], func(i, j int) bool {
+			return ops[start+i].kind == '-' && ops[start+j].kind == '+'
+		})
+		start = end
+	}
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// count returns the amount of lines of both outputs in the ops
+func count(ops []diffOp) (from, to int) {
+	for _, op := range ops {
+		if op.kind != '+' {
+			from++
+		}
+		if op.kind != '-' {
+			to++
+		}
+	}
+	return from, to
+}
+
+func advance(ops []diffOp, fromLine, toLine int) (int, int) {
+	from, to := count(ops)
+	return fromLine + from, toLine + to
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// patterns is a repeatable flag value
+type patterns []string
+
+func (p *patterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patterns) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// watchSpec describes a single -watch value: the directory to watch and which files in it are watched
+type watchSpec struct {
+	dir       string
+	recursive bool
+	match     func(path string) bool
+}
+
+// newWatchSpec creates a spec for a directory (watched recursively), a file or a glob pattern.
+// A pattern is watched in its longest directory prefix without glob characters, so new matching files are noticed.
+func newWatchSpec(path string) watchSpec {
+	path = filepath.Clean(path)
+	if !hasMeta(path) {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return watchSpec{dir: path, recursive: true, match: func(string) bool { return true }}
+		}
+		return watchSpec{dir: filepath.Dir(path), match: func(p string) bool { return p == path }}
+	}
+
+	var base []string
+	for _, part := range strings.Split(path, string(filepath.Separator)) {
+		if hasMeta(part) {
+			break
+		}
+		base = append(base, part)
+	}
+	dir := strings.Join(base, string(filepath.Separator))
+	if dir == "" {
+		dir = "."
+		if filepath.IsAbs(path) {
+			dir = string(filepath.Separator)
+		}
+	}
+	return watchSpec{dir: dir, recursive: true, match: func(p string) bool {
+		ok, _ := filepath.Match(path, p)
+		return ok
+	}}
+}
+
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+// ignored reports whether the path matches any of the -ignore patterns by its base name or by the whole path
+func ignored(ignore []string, path string) bool {
+	for _, pattern := range ignore {
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// watchFiles reports changes of the files in cfg.watch, the changes within cfg.debounce of each other are reported once.
+// inotify is used on Linux, the files are polled every cfg.poll on other systems, if inotify fails or if it is forced.
+func watchFiles(ctx context.Context, cfg config) <-chan struct{} {
+	specs := make([]watchSpec, 0, len(cfg.watch))
+	for _, path := range cfg.watch {
+		specs = append(specs, newWatchSpec(path))
+	}
+
+	events := make(chan string)
+	started := false
+	if !cfg.forcePoll {
+		if err := watchInotify(ctx, specs, cfg.ignore, events); err != nil {
+			log.Printf("watch files with inotify: %s, falling back to polling every %s", err, cfg.poll)
+		} else {
+			started = true
+		}
+	}
+	if !started {
+		go pollFiles(ctx, specs, cfg.ignore, cfg.poll, events)
+	}
+
+	changes := make(chan struct{}, 1)
+	go debounce(ctx, events, changes, cfg.debounce)
+	return changes
+}
+
+// debounce waits until there are no events for the period and then notifies about all of them at once
+func debounce(ctx context.Context, events <-chan string, changes chan<- struct{}, period time.Duration) {
+	// the timer is created with any non-zero period, a timer of a zero period fires before it is stopped,
+	// and its value left in the channel would report a change which did not happen
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+			timer.Reset(period)
+		case <-timer.C:
+			select {
+			case changes <- struct{}{}:
+			default:
+				// the previous change is not handled yet, it will trigger a run anyway
+			}
+		}
+	}
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// pollFiles compares modification times and sizes of the watched files every interval
+func pollFiles(ctx context.Context, specs []watchSpec, ignore []string, interval time.Duration, events chan<- string) {
+	prev := snapshot(specs, ignore)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cur := snapshot(specs, ignore)
+		for path, state := range cur {
+			if prevState, ok := prev[path]; !ok || prevState != state {
+				notify(ctx, events, path)
+			}
+		}
+		for path := range prev {
+			if _, ok := cur[path]; !ok {
+				notify(ctx, events, path)
+			}
+		}
+		prev = cur
+	}
+}
+
+func notify(ctx context.Context, events chan<- string, path string) {
+	select {
+	case events <- path:
+	case <-ctx.Done():
+	}
+}
+
+func snapshot(specs []watchSpec, ignore []string) map[string]fileState {
+	files := map[string]fileState{}
+	for _, spec := range specs {
+		filepath.WalkDir(spec.dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// the file may be removed during the walk, missing files are reported as removed
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if path != spec.dir && ignored(ignore, path) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				if path != spec.dir && !spec.recursive {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !spec.match(path) {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			files[path] = fileState{modTime: info.ModTime(), size: info.Size()}
+			return nil
+		})
+	}
+	return files
+}
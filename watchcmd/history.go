@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// historyRecord is a line of the -history file
+type historyRecord struct {
+	// Job is the name of the job in -config mode
+	Job        string    `json:"job,omitempty"`
+	Command    string    `json:"command"`
+	Start      time.Time `json:"start"`
+	DurationMs float64   `json:"duration_ms"`
+	ExitCode   int       `json:"exit_code"`
+	Status     string    `json:"status"`
+	OutputHash string    `json:"output_hash"`
+	// Output is nil if it is not recorded, so an empty output can be told apart. It is encoded in base64,
+	// so the output which is not valid UTF-8 is kept as is and matches OutputHash.
+	Output *[]byte `json:"output,omitempty"`
+}
+
+// history appends a record for every finished run to the -history file
+type history struct {
+	f       *os.File
+	enc     *json.Encoder
+	job     string
+	command string
+	output  bool
+}
+
+// openHistory opens the -history file for appending, it returns nil if the history is not recorded
+func openHistory(cfg config) (*history, error) {
+	if cfg.history == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(cfg.history, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open history: %w", err)
+	}
+	return &history{f: f, enc: json.NewEncoder(f), job: cfg.name, command: commandLine(cfg), output: cfg.historyOutput}, nil
+}
+
+// add records the run, the file is opened in append mode, so every record is written with a single write
+func (h *history) add(res result) error {
+	if h == nil {
+		return nil
+	}
+	rec := newHistoryRecord(h.command, res, h.output)
+	rec.Job = h.job
+	if err := h.enc.Encode(rec); err != nil {
+		return fmt.Errorf("write history: %w", err)
+	}
+	return nil
+}
+
+func newHistoryRecord(command string, res result, withOutput bool) historyRecord {
+	rec := historyRecord{
+		Command:    command,
+		Start:      res.start,
+		DurationMs: float64(res.duration.Microseconds()) / 1000,
+		ExitCode:   res.exitCode(),
+		Status:     res.status(),
+		OutputHash: outputHash(res.output),
+	}
+	if withOutput {
+		out := res.output
+		if out == nil {
+			out = []byte{}
+		}
+		rec.Output = &out
+	}
+	return rec
+}
+
+func (h *history) close() error {
+	if h == nil {
+		return nil
+	}
+	return h.f.Close()
+}
+
+func outputHash(out []byte) string {
+	sum := sha256.Sum256(out)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// runHistory is the history subcommand:
+//
+//	watchcmd history [-file history.jsonl] [list]
+//	watchcmd history [-file history.jsonl] show <run>
+//	watchcmd history [-file history.jsonl] diff <run> <run>
+//
+// Runs are numbered from 1 in the order of the file, negative numbers count from the end, -1 is the last run.
+func runHistory(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	file := fs.String("file", "watchcmd.jsonl", "history file written with -history")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	records, err := readHistory(*file)
+	if err != nil {
+		return err
+	}
+
+	args = fs.Args()
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		return listHistory(stdout, records)
+	case args[0] == "show" && len(args) == 2:
+		rec, err := findRun(records, args[1])
+		if err != nil {
+			return err
+		}
+		if rec.Output == nil {
+			return fmt.Errorf("output of run %s is not recorded, use -history-output", args[1])
+		}
+		_, err = stdout.Write(*rec.Output)
+		return err
+	case args[0] == "diff" && len(args) == 3:
+		from, err := findRun(records, args[1])
+		if err != nil {
+			return err
+		}
+		to, err := findRun(records, args[2])
+		if err != nil {
+			return err
+		}
+		if from.Output == nil || to.Output == nil {
+			return fmt.Errorf("output of runs is not recorded, use -history-output")
+		}
+		return diffLines(stdout, string(*from.Output), string(*to.Output))
+	}
+	return errors.New("usage: watchcmd history [-file history.jsonl] [list | show <run> | diff <run> <run>]")
+}
+
+func readHistory(path string) ([]historyRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open history: %w", err)
+	}
+	defer f.Close()
+
+	var records []historyRecord
+	scanner := bufio.NewScanner(f)
+	// a line holds the whole output of a run
+	scanner.Buffer(nil, 64<<20)
+	for n := 1; scanner.Scan(); n++ {
+		var rec historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("parse history line %d: %w", n, err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read history: %w", err)
+	}
+	return records, nil
+}
+
+// listHistory prints a line for every run, * marks the runs which output differs from the previous run of the same
+// job and command, the runs of several jobs or watchcmd processes are mixed in the file
+func listHistory(w io.Writer, records []historyRecord) error {
+	type source struct{ job, command string }
+	prevHash := map[source]string{}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tSTART\tDURATION\tSTATUS\tOUTPUT\tCOMMAND")
+	for i, rec := range records {
+		changed := ""
+		src := source{job: rec.Job, command: rec.Command}
+		if prev, ok := prevHash[src]; ok && rec.OutputHash != prev {
+			changed = " *"
+		}
+		prevHash[src] = rec.OutputHash
+		command := rec.Command
+		if rec.Job != "" {
+			command = rec.Job + ": " + command
+		}
+		duration := time.Duration(rec.DurationMs * float64(time.Millisecond)).Round(time.Millisecond)
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%.19s%s\t%s\n",
+			i+1, rec.Start.Format(time.DateTime), duration, rec.Status, rec.OutputHash, changed, command)
+	}
+	return tw.Flush()
+}
+
+func findRun(records []historyRecord, run string) (historyRecord, error) {
+	n, err := strconv.Atoi(run)
+	if err != nil {
+		return historyRecord{}, fmt.Errorf("invalid run %q", run)
+	}
+	if n < 0 {
+		n += len(records) + 1
+	}
+	if n < 1 || n > len(records) {
+		return historyRecord{}, fmt.Errorf("run %s not found, there are %d runs", run, len(records))
+	}
+	return records[n-1], nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// maxEnvOutput is the maximal size of the output passed to the hook in an environment variable,
+// the kernel limits the size of a single variable, so larger outputs are only available in the files
+const maxEnvOutput = 32 << 10
+
+// runHook runs cfg.onChange with sh -c when the output changes. The old and the new output are passed
+// in WATCHCMD_OLD_OUTPUT and WATCHCMD_NEW_OUTPUT environment variables and in temporary files
+// which paths are in WATCHCMD_OLD_FILE and WATCHCMD_NEW_FILE, the files are removed after the hook exits.
+// The hook blocks the watcher, so like the command it is stopped with its children after cfg.hookTimeout
+// or when ctx is cancelled.
+func runHook(ctx context.Context, cfg config, old, new []byte) error {
+	oldFile, err := writeTemp("watchcmd-old-*", old)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(oldFile)
+
+	newFile, err := writeTemp("watchcmd-new-*", new)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(newFile)
+
+	if cfg.hookTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.hookTimeout)
+		defer cancel()
+	}
+
+	c := exec.CommandContext(ctx, "sh", "-c", cfg.onChange)
+	setProcessGroup(c)
+	var kill *time.Timer
+	c.Cancel = func() error {
+		kill = time.AfterFunc(cfg.grace, func() { killGroup(c) })
+		return terminateGroup(c)
+	}
+	c.WaitDelay = cfg.grace
+	c.Env = append(os.Environ(),
+		"WATCHCMD_OLD_FILE="+oldFile,
+		"WATCHCMD_NEW_FILE="+newFile,
+		"WATCHCMD_OLD_OUTPUT="+envOutput(old),
+		"WATCHCMD_NEW_OUTPUT="+envOutput(new),
+	)
+	// stdout is occupied by the screen
+	c.Stdout = os.Stderr
+	c.Stderr = os.Stderr
+	err = c.Run()
+	if kill != nil {
+		kill.Stop()
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("run hook: timeout %s", cfg.hookTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("run hook: %w", err)
+	}
+	return nil
+}
+
+func writeTemp(pattern string, data []byte) (string, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("write temp file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+func envOutput(out []byte) string {
+	if len(out) > maxEnvOutput {
+		return ""
+	}
+	return string(out)
+}
@@ -0,0 +1,162 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_ATTRIB | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// inotify maps watch descriptors to the watched directories and the specs they are watched for
+type inotify struct {
+	fd     int
+	specs  []watchSpec
+	ignore []string
+	dirs   map[int32]*inotifyDir
+}
+
+type inotifyDir struct {
+	path  string
+	specs []int
+}
+
+// watchInotify watches the directories of the specs with inotify and sends the paths of changed files to events
+func watchInotify(ctx context.Context, specs []watchSpec, ignore []string, events chan<- string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+	// a non-blocking descriptor is handled by the runtime poller, so Close interrupts the blocked Read
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	in := &inotify{fd: fd, specs: specs, ignore: ignore, dirs: map[int32]*inotifyDir{}}
+	for i, spec := range specs {
+		if err := in.add(i, spec.dir); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	go in.read(ctx, f, events)
+	return nil
+}
+
+// add watches the directory and, if the spec is recursive, all its subdirectories which are not ignored
+func (in *inotify) add(spec int, dir string) error {
+	if !in.specs[spec].recursive {
+		return in.addDir(spec, dir)
+	}
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != dir && ignored(in.ignore, path) {
+			return filepath.SkipDir
+		}
+		return in.addDir(spec, path)
+	})
+}
+
+func (in *inotify) addDir(spec int, path string) error {
+	wd, err := syscall.InotifyAddWatch(in.fd, path, inotifyMask)
+	if err != nil {
+		return fmt.Errorf("watch %s: %w", path, err)
+	}
+
+	// the same directory may be watched for several specs, it has the same descriptor then
+	dir, ok := in.dirs[int32(wd)]
+	if !ok {
+		dir = &inotifyDir{path: path}
+		in.dirs[int32(wd)] = dir
+	}
+	for _, s := range dir.specs {
+		if s == spec {
+			return nil
+		}
+	}
+	dir.specs = append(dir.specs, spec)
+	return nil
+}
+
+func (in *inotify) read(ctx context.Context, f *os.File, events chan<- string) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("read inotify events: %s", err)
+			}
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + syscall.SizeofInotifyEvent
+			off = start + int(ev.Len)
+			name := string(bytes.TrimRight(buf[start:off], "\x00"))
+
+			if path, ok := in.handle(ev.Wd, ev.Mask, name); ok {
+				notify(ctx, events, path)
+			}
+		}
+	}
+}
+
+// handle returns the path of the changed file if it is watched
+func (in *inotify) handle(wd int32, mask uint32, name string) (string, bool) {
+	// some events are lost, so anything may have changed
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		return "", true
+	}
+
+	dir, ok := in.dirs[wd]
+	if !ok {
+		return "", false
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(in.dirs, wd)
+		return "", false
+	}
+
+	path := filepath.Join(dir.path, name)
+	if ignored(in.ignore, path) {
+		return "", false
+	}
+
+	// new subdirectories of recursively watched directories are watched as well
+	if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		for _, spec := range dir.specs {
+			if !in.specs[spec].recursive {
+				continue
+			}
+			if err := in.add(spec, path); err != nil {
+				log.Printf("watch new directory: %s", err)
+			}
+		}
+	}
+
+	for _, spec := range dir.specs {
+		if in.specs[spec].match(path) {
+			return path, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// watchInotify is not available, the files are polled instead
+func watchInotify(ctx context.Context, specs []watchSpec, ignore []string, events chan<- string) error {
+	return errors.New("not supported on this system")
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// jobSpec is a job of the -config file, the zero fields are taken from the flags
+type jobSpec struct {
+	Command  string        `yaml:"command"`
+	Interval time.Duration `yaml:"interval"`
+	Schedule string        `yaml:"schedule"`
+	TZ       string        `yaml:"tz"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Overlap  string        `yaml:"overlap"`
+}
+
+type jobsFile struct {
+	Jobs map[string]jobSpec `yaml:"jobs"`
+}
+
+// loadJobs reads the -config file and checks that every job can be run
+func loadJobs(base config) (map[string]config, map[string]jobSpec, error) {
+	f, err := os.Open(base.configFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open config: %w", err)
+	}
+	defer f.Close()
+
+	var file jobsFile
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, nil, fmt.Errorf("parse config: %w", err)
+	}
+	if len(file.Jobs) == 0 {
+		return nil, nil, fmt.Errorf("no jobs in config %s", base.configFile)
+	}
+
+	configs := make(map[string]config, len(file.Jobs))
+	for name, spec := range file.Jobs {
+		cfg, err := jobConfig(base, name, spec)
+		if err != nil {
+			return nil, nil, fmt.Errorf("job %s: %w", name, err)
+		}
+		configs[name] = cfg
+	}
+	return configs, file.Jobs, nil
+}
+
+// jobConfig overrides the flags with the fields of the job, the command is run with sh -c
+func jobConfig(base config, name string, spec jobSpec) (config, error) {
+	cfg := base
+	cfg.name = name
+	cfg.cmd, cfg.args, cfg.shell = spec.Command, nil, true
+	if spec.Command == "" {
+		return cfg, fmt.Errorf("no command")
+	}
+
+	switch {
+	case spec.Interval < 0:
+		return cfg, fmt.Errorf("invalid interval %s, must be positive", spec.Interval)
+	case spec.Interval > 0 && spec.Schedule != "":
+		return cfg, fmt.Errorf("interval and schedule can not be used together")
+	case spec.Interval > 0:
+		cfg.interval, cfg.schedule = spec.Interval, ""
+	case spec.Schedule != "":
+		cfg.schedule, cfg.precise = spec.Schedule, false
+	}
+	if spec.TZ != "" {
+		cfg.timezone = spec.TZ
+	}
+	if err := cfg.parseCron(); err != nil {
+		return cfg, err
+	}
+
+	if spec.Timeout < 0 {
+		return cfg, fmt.Errorf("invalid timeout %s", spec.Timeout)
+	}
+	if spec.Timeout > 0 {
+		cfg.timeout = spec.Timeout
+	}
+	if spec.Overlap != "" {
+		if !contains(overlapPolicies, spec.Overlap) {
+			return cfg, fmt.Errorf("invalid overlap policy %q, allowed policies: %s", spec.Overlap, overlapPolicies)
+		}
+		cfg.overlap = spec.Overlap
+	}
+	return cfg, nil
+}
+
+// job is a running job, done is closed when it stops
+type job struct {
+	name   string
+	spec   jobSpec
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (j *job) stop() {
+	j.cancel()
+	<-j.done
+}
+
+// runJobs runs the jobs of the -config file concurrently until ctx is cancelled or all of them are done.
+// On SIGHUP the file is read again: the removed and changed jobs are stopped, the new and changed ones are started.
+// If the new file is invalid the running jobs are kept. The metrics of the jobs are recorded in ms.
+func runJobs(ctx context.Context, base config, ms *metricsSet) error {
+	configs, specs, err := loadJobs(base)
+	if err != nil {
+		return err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	jobs := map[string]*job{}
+	finished := make(chan *job)
+	defer func() {
+		for _, j := range jobs {
+			j.stop()
+		}
+	}()
+
+	start := func(name string) {
+		jobCtx, cancel := context.WithCancel(ctx)
+		j := &job{name: name, spec: specs[name], cancel: cancel, done: make(chan struct{})}
+		jobs[name] = j
+
+		go func(cfg config) {
+			if err := repeat(jobCtx, cfg, newJobScreen(cfg), ms.get(cfg)); err != nil {
+				log.Printf("%s: %s", cfg.name, err)
+			}
+			close(j.done)
+			select {
+			case finished <- j:
+			case <-ctx.Done():
+			}
+		}(configs[name])
+	}
+	for _, name := range sortedNames(specs) {
+		start(name)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case j := <-finished:
+			// a stopped job may have been replaced already
+			if jobs[j.name] == j {
+				delete(jobs, j.name)
+			}
+			if len(jobs) == 0 {
+				log.Printf("all jobs are done")
+				return nil
+			}
+		case <-hup:
+			newConfigs, newSpecs, err := loadJobs(base)
+			if err != nil {
+				log.Printf("reload config: %s, keeping the running jobs", err)
+				continue
+			}
+
+			var stopped, started int
+			for name, j := range jobs {
+				if spec, ok := newSpecs[name]; !ok || spec != j.spec {
+					j.stop()
+					delete(jobs, name)
+					stopped++
+				}
+			}
+			// a changed job keeps counting, the series of a removed job are dropped
+			for name := range specs {
+				if _, ok := newSpecs[name]; !ok {
+					ms.remove(name)
+				}
+			}
+			configs, specs = newConfigs, newSpecs
+			for _, name := range sortedNames(specs) {
+				if _, ok := jobs[name]; !ok {
+					start(name)
+					started++
+				}
+			}
+			log.Printf("config reloaded: %d jobs, stopped %d, started %d", len(jobs), stopped, started)
+		}
+	}
+}
+
+func sortedNames(specs map[string]jobSpec) []string {
+	names := make([]string, 0, len(specs))
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newJobScreen appends the output of the job to stdout with the name of the job before every line
+func newJobScreen(cfg config) *screen {
+	return &screen{
+		w:          newPrefixWriter(os.Stdout, cfg.name),
+		title:      title(cfg),
+		noTitle:    true,
+		stream:     cfg.stream,
+		timestamps: cfg.timestamps,
+		separator:  cfg.separator,
+	}
+}
+
+// outputMu keeps the lines of the jobs from being mixed
+var outputMu sync.Mutex
+
+// prefixWriter writes every line with a prefix. An incomplete line is kept until it is completed or flushed.
+type prefixWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	prefix  []byte
+	partial []byte
+}
+
+func newPrefixWriter(w io.Writer, name string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(name + " | ")}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.partial = append(p.partial, b...)
+	end := bytes.LastIndexByte(p.partial, '\n')
+	if end < 0 {
+		return len(b), nil
+	}
+	err := p.writeLines(p.partial[:end+1])
+	p.partial = append(p.partial[:0], p.partial[end+1:]...)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// flush writes the incomplete line, e.g. if the output does not end with a new line
+func (p *prefixWriter) flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.partial) == 0 {
+		return nil
+	}
+	err := p.writeLines(append(p.partial, '\n'))
+	p.partial = p.partial[:0]
+	return err
+}
+
+func (p *prefixWriter) writeLines(lines []byte) error {
+	var buf bytes.Buffer
+	for len(lines) > 0 {
+		end := bytes.IndexByte(lines, '\n')
+		buf.Write(p.prefix)
+		buf.Write(lines[:end+1])
+		lines = lines[end+1:]
+	}
+
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	_, err := p.w.Write(buf.Bytes())
+	return err
+}
@@ -6,13 +6,19 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"syscall"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		failIfErr(runHistory(os.Args[2:], os.Stdout))
+		return
+	}
+
 	cfg, err := getConfig()
 	failIfErr(err)
 
@@ -30,44 +36,109 @@ func main() {
 		cancel()
 	}()
 
-	err = repeat(ctx, cfg)
+	// ms is nil and the metrics are not recorded if they are not served
+	var ms *metricsSet
+	if cfg.metricsAddr != "" {
+		ms = newMetricsSet()
+		stop, err := serveMetrics(cfg.metricsAddr, ms)
+		failIfErr(err)
+		defer stop()
+	}
+
+	if cfg.configFile != "" {
+		err = runJobs(ctx, cfg, ms)
+	} else {
+		err = repeat(ctx, cfg, newScreen(os.Stdout, cfg), ms.get(cfg))
+	}
 	failIfErr(err)
 }
 
-func repeat(ctx context.Context, cfg config) error {
-	// run once before starting the loop
-	if err := runCmd(cfg.cmd, cfg.args...); err != nil {
+// repeat runs the command until watching is done, m is nil if the metrics are not served
+func repeat(ctx context.Context, cfg config, scr *screen, m *metrics) error {
+	// redraw the last output when the terminal is resized
+	resize := make(chan os.Signal, 1)
+	stopResize := notifyResize(resize)
+	defer stopResize()
+
+	hist, err := openHistory(cfg)
+	if err != nil {
 		return err
 	}
+	defer hist.close()
 
-	// run the command every cfg.interval using a ticker
+	// runs are cancelled when watching is done for any reason
+	ctx, cancel := context.WithCancel(ctx)
+	w := newWatcher(cfg, scr, hist, m)
+	defer w.wait()
+	defer cancel()
+	// the error is reported after the last output
+	defer scr.leave()
+
+	// run once before starting the loop, unless the runs are scheduled with -schedule
+	scheduled := time.Now()
+	if cfg.schedule == "" {
+		w.start(ctx)
+	}
+
+	// changes is nil and never fires if no files are watched
+	var changes <-chan struct{}
+	if len(cfg.watch) > 0 {
+		changes = watchFiles(ctx, cfg)
+	}
+
+	// run the command at the times of the schedule, the runs happen in separate goroutines,
+	// so the loop keeps track of the ticks while the command is running and applies the overlap policy.
+	// There is no schedule if -interval is 0 and the command runs only when the files change.
 	// stop repeating when the context is cancelled
-	ticker := time.NewTicker(cfg.interval)
-	defer ticker.Stop()
+	var (
+		sched schedule
+		next  time.Time
+		timer *time.Timer
+		ticks <-chan time.Time
+	)
+	if cfg.schedule != "" || cfg.interval > 0 {
+		sched = newSchedule(cfg)
+		next, _ = nextAfter(sched, scheduled, time.Now())
+		w.scheduled(next)
+		timer = time.NewTimer(time.Until(next))
+		defer timer.Stop()
+		ticks = timer.C
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("context cancelled")
+			scr.leave()
+			w.log.Printf("context cancelled, %s", w.summary())
 			return nil
-		case <-ticker.C:
-			if err := runCmd(cfg.cmd, cfg.args...); err != nil {
-				log.Printf("error running command: %s", err)
+		case <-resize:
+			scr.redraw()
+		case <-changes:
+			w.change(ctx)
+		case <-w.retry:
+			w.retried(ctx)
+		case l := <-w.lines:
+			w.live(l)
+		case <-w.redraw:
+			w.redrawLive()
+		case now := <-ticks:
+			w.tick(ctx, now.Sub(next))
+
+			var missed int
+			next, missed = nextAfter(sched, next, now)
+			if missed > 0 {
+				w.skip(missed)
+			}
+			w.scheduled(next)
+			timer.Reset(time.Until(next))
+		case f := <-w.results:
+			if done, err := w.done(ctx, f); done {
+				return err
 			}
 		}
 	}
 }
 
-func runCmd(cmd string, args ...string) error {
-	c := exec.Command(cmd, args...)
-	out, err := c.Output()
-	if err != nil {
-		return err
-	}
-	os.Stdout.Write(out)
-	return nil
-}
-
 func failIfErr(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -76,24 +147,215 @@ func failIfErr(err error) {
 
 type config struct {
 	interval time.Duration
-	cmd      string
-	args     []string
+	diff     diffMode
+	noTitle  bool
+	shell    bool
+	stderr   string
+	errexit  bool
+	beep     bool
+	chgexit  bool
+	// untilRegex is nil and untilExitCode is negative if the conditions are not set
+	untilRegex    *regexp.Regexp
+	untilExitCode int
+	onChange      string
+	hookTimeout   time.Duration
+	timeout       time.Duration
+	grace         time.Duration
+	overlap       string
+	precise       bool
+	schedule      string
+	timezone      string
+	// location is the loaded -tz
+	location *time.Location
+	// cron is the parsed -schedule
+	cron schedule
+	// watch holds the -watch paths and globs, the command also runs when the matching files change
+	watch     patterns
+	ignore    patterns
+	debounce  time.Duration
+	forcePoll bool
+	poll      time.Duration
+	// retries is the amount of retries of a failed run, breaker is the amount of consecutive failures which pause
+	// the runs for breakerPause, 0 disables them
+	retries        int
+	backoffInitial time.Duration
+	backoffMax     time.Duration
+	jitter         float64
+	breaker        int
+	breakerPause   time.Duration
+	// history is the file to record the runs to, historyOutput records their output as well
+	history       string
+	historyOutput bool
+	metricsAddr   string
+	// configFile is the -config file with the jobs, name is the name of the job the config is for
+	configFile string
+	name       string
+	// stream shows the output while the command is running, timestamps implies it
+	stream     bool
+	timestamps bool
+	separator  bool
+	cmd        string
+	args       []string
+}
+
+// until reports whether watching is done after the run and why
+func (cfg config) until(res result, changed bool) (bool, string) {
+	switch {
+	case cfg.chgexit && changed:
+		return true, "output changed"
+	case cfg.untilRegex != nil && cfg.untilRegex.Match(res.output):
+		return true, fmt.Sprintf("output matches %q", cfg.untilRegex)
+	case cfg.untilExitCode >= 0 && res.exitCode() == cfg.untilExitCode:
+		return true, fmt.Sprintf("command exited with status %d", cfg.untilExitCode)
+	}
+	return false, ""
 }
 
 func getConfig() (config, error) {
 	var cfg config
 
 	flag.DurationVar(&cfg.interval, "interval", 2*time.Second, "interval to wait between runs")
+	flag.Var(&cfg.diff, "d", "highlight the differences between successive runs, -d=cumulative highlights everything that has ever changed")
+	flag.Var(&cfg.diff, "differences", "alias for -d")
+	flag.BoolVar(&cfg.noTitle, "no-title", false, "do not show the header with the interval, the command, the hostname and the time")
+	flag.BoolVar(&cfg.noTitle, "t", false, "alias for -no-title")
+	flag.BoolVar(&cfg.shell, "shell", false, "run the command with sh -c, so pipes and other shell syntax can be used")
+	flag.StringVar(&cfg.stderr, "stderr", "stream", fmt.Sprintf("what to do with stderr of the command %s", stderrModes))
+	flag.BoolVar(&cfg.errexit, "errexit", false, "exit when the command exits with non-zero status")
+	flag.BoolVar(&cfg.beep, "beep", false, "beep when the command exits with non-zero status")
+	flag.BoolVar(&cfg.chgexit, "chgexit", false, "exit when the output of the command changes")
+	flag.Func("until-regex", "exit when the output of the command matches the regular expression", func(value string) error {
+		re, err := regexp.Compile(value)
+		cfg.untilRegex = re
+		return err
+	})
+	flag.IntVar(&cfg.untilExitCode, "until-exit-code", -1, "exit when the command exits with that status, negative disables the condition")
+	flag.DurationVar(&cfg.timeout, "timeout", 0, "stop the command if a single run takes longer, 0 disables the timeout")
+	flag.DurationVar(&cfg.grace, "grace", 5*time.Second, "time between SIGTERM and SIGKILL when the command is stopped")
+	flag.StringVar(&cfg.overlap, "overlap", "skip", fmt.Sprintf("what to do when the next run is due while the command is still running %s", overlapPolicies))
+	flag.BoolVar(&cfg.precise, "precise", false, "run at wall-clock multiples of the interval instead of counting it from the first run")
+	flag.StringVar(&cfg.schedule, "schedule", "", "cron expression with 5 or 6 fields or a descriptor like @hourly or @every 5m, overrides -interval")
+	flag.StringVar(&cfg.timezone, "tz", "", "time zone of -schedule and -precise, e.g. Europe/Moscow (if not set: local time zone)")
+	flag.StringVar(&cfg.onChange, "on-change", "", "command to run with sh -c when the output changes, see README for the passed variables")
+	flag.DurationVar(&cfg.hookTimeout, "on-change-timeout", 30*time.Second, "stop the -on-change command if it takes longer, 0 disables the timeout")
+	flag.Var(&cfg.watch, "watch", "run the command when files change: a file, a directory (watched recursively) or a glob, can be repeated")
+	flag.Var(&cfg.ignore, "ignore", "glob of the file names or paths to ignore in -watch, e.g. '*.swp' or .git, can be repeated")
+	flag.DurationVar(&cfg.debounce, "debounce", 100*time.Millisecond, "run once after the files stop changing for that long")
+	flag.BoolVar(&cfg.forcePoll, "poll", false, "poll the -watch files instead of using inotify, e.g. on network file systems")
+	flag.DurationVar(&cfg.poll, "poll-interval", time.Second, "interval to check the -watch files when they are polled")
+	flag.IntVar(&cfg.retries, "retries", 0, "retry a failed run that many times with exponential backoff before the next regular run")
+	flag.DurationVar(&cfg.backoffInitial, "backoff-initial", time.Second, "delay before the first retry, it doubles on every retry")
+	flag.DurationVar(&cfg.backoffMax, "backoff-max", time.Minute, "maximum delay between retries")
+	flag.Float64Var(&cfg.jitter, "jitter", 0.1, "random change of the retry delay as a fraction of it, from 0 to 1")
+	flag.IntVar(&cfg.breaker, "breaker", 0, "pause the runs after that many consecutive failures, 0 disables the circuit breaker")
+	flag.DurationVar(&cfg.breakerPause, "breaker-pause", 5*time.Minute, "how long the runs are paused by the circuit breaker")
+	flag.StringVar(&cfg.history, "history", "", "append a JSON line for every run to the file, see `watchcmd history`")
+	flag.BoolVar(&cfg.historyOutput, "history-output", false, "record the output of the runs to -history as well")
+	flag.StringVar(&cfg.metricsAddr, "metrics-addr", "", "address to serve Prometheus metrics on /metrics and the last run on /status, e.g. :9100, with -config the series have the job label")
+	flag.StringVar(&cfg.configFile, "config", "", "YAML file with the jobs to run instead of the command, the flags are defaults for the jobs")
+	flag.BoolVar(&cfg.stream, "stream", false, "show the output line by line while the command is running")
+	flag.BoolVar(&cfg.timestamps, "timestamps", false, "prefix every streamed line with the time it was written, implies -stream")
+	flag.BoolVar(&cfg.separator, "separator", false, "write a line with the number and the start time before the output of every run")
 	flag.Parse()
 
 	args := flag.Args()
-	if len(args) == 0 {
-		return cfg, fmt.Errorf("no command specified. usage: watchcmd [flags] <cmd> [args]")
+	switch {
+	case cfg.configFile != "" && len(args) > 0:
+		return cfg, fmt.Errorf("command can not be used with -config, the commands are defined in the jobs")
+	case cfg.configFile == "" && len(args) == 0:
+		return cfg, fmt.Errorf("no command specified. usage: watchcmd [flags] <cmd> [args], watchcmd [flags] -config jobs.yaml " +
+			"or watchcmd history [-file history.jsonl] [list | show <run> | diff <run> <run>]")
+	}
+
+	// -interval 0 runs the command only when the watched files change
+	if cfg.interval < 0 || cfg.interval == 0 && len(cfg.watch) == 0 {
+		return cfg, fmt.Errorf("invalid interval %s, must be positive (or 0 with -watch)", cfg.interval)
+	}
+	for _, path := range cfg.watch {
+		spec := newWatchSpec(path)
+		if _, err := os.Stat(spec.dir); err != nil {
+			return cfg, fmt.Errorf("invalid -watch %q: %w", path, err)
+		}
+	}
+	for _, pattern := range cfg.ignore {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return cfg, fmt.Errorf("invalid -ignore %q: %w", pattern, err)
+		}
+	}
+	if cfg.debounce < 0 || cfg.poll <= 0 {
+		return cfg, fmt.Errorf("invalid -debounce %s or -poll-interval %s", cfg.debounce, cfg.poll)
+	}
+	if err := cfg.parseCron(); err != nil {
+		return cfg, err
+	}
+	if cfg.retries < 0 || cfg.breaker < 0 {
+		return cfg, fmt.Errorf("invalid -retries %d or -breaker %d, must not be negative", cfg.retries, cfg.breaker)
+	}
+	if cfg.backoffInitial <= 0 || cfg.backoffMax < cfg.backoffInitial {
+		return cfg, fmt.Errorf("invalid backoff from %s to %s, must be positive and increasing", cfg.backoffInitial, cfg.backoffMax)
+	}
+	if cfg.jitter < 0 || cfg.jitter > 1 {
+		return cfg, fmt.Errorf("invalid jitter %g, must be from 0 to 1", cfg.jitter)
+	}
+	if cfg.breakerPause <= 0 {
+		return cfg, fmt.Errorf("invalid -breaker-pause %s, must be positive", cfg.breakerPause)
+	}
+	if !contains(overlapPolicies, cfg.overlap) {
+		return cfg, fmt.Errorf("invalid overlap policy %q, allowed policies: %s", cfg.overlap, overlapPolicies)
+	}
+	if !contains(stderrModes, cfg.stderr) {
+		return cfg, fmt.Errorf("invalid stderr mode %q, allowed modes: %s", cfg.stderr, stderrModes)
 	}
 
+	if cfg.timestamps {
+		cfg.stream = true
+	}
+
+	if len(args) == 0 {
+		return cfg, nil
+	}
 	cfg.cmd = args[0]
 	if len(args) > 1 {
 		cfg.args = args[1:]
 	}
 	return cfg, nil
 }
+
+// parseCron loads -tz and parses -schedule if it is set
+func (cfg *config) parseCron() error {
+	cfg.cron = nil
+	// time.LoadLocation returns UTC for an empty name
+	cfg.location = time.Local
+	if cfg.timezone != "" {
+		loc, err := time.LoadLocation(cfg.timezone)
+		if err != nil {
+			return fmt.Errorf("invalid time zone %q: %w", cfg.timezone, err)
+		}
+		cfg.location = loc
+	}
+
+	if cfg.schedule == "" {
+		return nil
+	}
+	if cfg.precise {
+		return fmt.Errorf("-precise can not be used with -schedule")
+	}
+
+	var err error
+	if cfg.cron, err = parseSchedule(cfg.schedule, cfg.location); err != nil {
+		return fmt.Errorf("invalid schedule %q: %w", cfg.schedule, err)
+	}
+	if cfg.cron.next(time.Now()).IsZero() {
+		return fmt.Errorf("schedule %q never fires", cfg.schedule)
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
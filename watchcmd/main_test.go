@@ -0,0 +1,997 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func Test_cronScheduleNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		expr string
+		loc  *time.Location
+		from string
+		want string
+	}{
+		{"*/15 * * * *", time.UTC, "2026-10-19T03:14:59Z", "2026-10-19T03:15:00Z"},
+		{"*/15 * * * *", time.UTC, "2026-10-19T03:15:00Z", "2026-10-19T03:30:00Z"},
+		{"*/10 * * * * *", time.UTC, "2026-10-19T03:14:55.5Z", "2026-10-19T03:15:00Z"},
+		{"0 4 * * mon-fri", time.UTC, "2026-10-23T05:00:00Z", "2026-10-26T04:00:00Z"},
+		{"0 0 1 jan *", time.UTC, "2026-10-19T00:00:00Z", "2027-01-01T00:00:00Z"},
+		{"0 0 29 2 *", time.UTC, "2026-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		// day of month and day of week match either of them, 2026-11-01 is Sunday
+		{"0 12 15 * 0", time.UTC, "2026-10-19T00:00:00Z", "2026-10-25T12:00:00Z"},
+		{"0 12 15 * 7", time.UTC, "2026-10-26T00:00:00Z", "2026-11-01T12:00:00Z"},
+		{"30 9 * * *", newYork, "2026-10-19T12:00:00Z", "2026-10-19T13:30:00Z"},
+		{"CRON_TZ=America/New_York 30 9 * * *", time.UTC, "2026-10-19T12:00:00Z", "2026-10-19T13:30:00Z"},
+		// 02:30 does not exist on the day daylight saving time starts
+		{"30 2 * * *", newYork, "2026-03-08T05:00:00Z", "2026-03-09T06:30:00Z"},
+		{"@hourly", time.UTC, "2026-10-19T03:14:00Z", "2026-10-19T04:00:00Z"},
+		{"@every 90s", time.UTC, "2026-10-19T03:14:00Z", "2026-10-19T03:15:30Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := parseSchedule(tt.expr, tt.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			from, _ := time.Parse(time.RFC3339Nano, tt.from)
+			want, _ := time.Parse(time.RFC3339, tt.want)
+			if got := s.next(from); !got.Equal(want) {
+				t.Errorf("next(%s) = %s, want %s", tt.from, got.UTC().Format(time.RFC3339), tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseScheduleErrors(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"@often",
+		"@every -1s",
+		"TZ=Nowhere/City * * * * *",
+	} {
+		if _, err := parseSchedule(expr, time.UTC); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func Test_watchSpec(t *testing.T) {
+	tests := []struct {
+		watch     string
+		dir       string
+		recursive bool
+		path      string
+		want      bool
+	}{
+		{"main.go", ".", false, "main.go", true},
+		{"main.go", ".", false, "screen.go", false},
+		{".", ".", true, "sub/file.txt", true},
+		{"*.go", ".", true, "main.go", true},
+		{"*.go", ".", true, "sub/main.go", false},
+		{"src/*/*.go", "src", true, "src/pkg/main.go", true},
+		{"./src/*.go", "src", true, "src/main_test.go", true},
+		{"/tmp/*.log", "/tmp", true, "/tmp/app.log", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.watch+" "+tt.path, func(t *testing.T) {
+			spec := newWatchSpec(tt.watch)
+			if spec.dir != tt.dir || spec.recursive != tt.recursive {
+				t.Errorf("newWatchSpec(%q) = %q, recursive %t, want %q, recursive %t", tt.watch, spec.dir, spec.recursive, tt.dir, tt.recursive)
+			}
+			if got := spec.match(tt.path); got != tt.want {
+				t.Errorf("match(%q) = %t, want %t", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	ignore := []string{".git", "*.swp", "build/*"}
+	for path, want := range map[string]bool{".git": true, "sub/.git": true, "main.go.swp": true, "build/out": true, "main.go": false} {
+		if got := ignored(ignore, path); got != want {
+			t.Errorf("ignored(%q) = %t, want %t", path, got, want)
+		}
+	}
+}
+
+func Test_backoff(t *testing.T) {
+	cfg := config{backoffInitial: time.Second, backoffMax: 10 * time.Second}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if got := backoff(cfg, attempt); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+
+	cfg.jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := backoff(cfg, 2); got < 2*time.Second || got > 6*time.Second {
+			t.Fatalf("backoff with jitter = %s, want from 2s to 6s", got)
+		}
+	}
+}
+
+func Test_diffLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     string
+	}{
+		{
+			name: "two hunks",
+			from: "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n",
+			to:   "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\n",
+			want: `@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -10,3 +10,4 @@
+ j
+ k
+ l
++m
+`,
+		},
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{"empty old", "", "a\nb\n", "@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"empty new", "a\nb\n", "", "@@ -1,2 +0,0 @@\n-a\n-b\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got strings.Builder
+			if err := diffLines(&got, tt.from, tt.to); err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("diffLines() =\n%s\nwant\n%s", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_lineDiff(t *testing.T) {
+	many := func(prefix string, n int) []string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = fmt.Sprintf("%s%d", prefix, i)
+		}
+		return lines
+	}
+
+	// 100 lines in the middle of long are replaced with 300 other lines
+	long := many("a", 10000)
+	changed := append(append(append([]string(nil), long[:5000]...), many("b", 300)...), long[5100:]...)
+
+	tests := []struct {
+		name      string
+		a, b      []string
+		wantEdits int
+	}{
+		{"empty", nil, nil, 0},
+		{"equal", []string{"a", "b"}, []string{"a", "b"}, 0},
+		{"added", nil, []string{"a", "b"}, 2},
+		{"removed", []string{"a", "b"}, nil, 2},
+		{"replaced", []string{"a", "b", "c"}, []string{"a", "x", "c"}, 2},
+		{"moved", []string{"a", "b", "c", "a", "b", "b", "a"}, []string{"c", "b", "a", "b", "a", "c"}, 5},
+		{"long equal", many("a", 10000), many("a", 10000), 0},
+		{"long changed", long, changed, 400},
+		{"long added to empty", nil, many("a", 500), 500},
+		{"long removed to empty", many("a", 500), nil, 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, ok := lineDiff(tt.a, tt.b)
+			if !ok {
+				t.Fatal("lineDiff() gave up")
+			}
+			var a, b []string
+			edits := 0
+			for _, op := range ops {
+				if op.kind != '+' {
+					a = append(a, op.line)
+				}
+				if op.kind != '-' {
+					b = append(b, op.line)
+				}
+				if op.kind != ' ' {
+					edits++
+				}
+			}
+			if strings.Join(a, "\n") != strings.Join(tt.a, "\n") || strings.Join(b, "\n") != strings.Join(tt.b, "\n") {
+				t.Errorf("lineDiff() = %v does not turn %q into %q", ops, tt.a, tt.b)
+			}
+			if edits != tt.wantEdits {
+				t.Errorf("lineDiff() has %d edits, want %d", edits, tt.wantEdits)
+			}
+		})
+	}
+
+	var got strings.Builder
+	from, to := strings.Join(many("a", 2000), "\n"), strings.Join(many("b", 2000), "\n")
+	if err := diffLines(&got, from, to); err != nil {
+		t.Fatal(err)
+	}
+	if want := "outputs differ in more than 1000 lines, 2000 lines and 2000 lines\n"; got.String() != want {
+		t.Errorf("diffLines() = %q, want %q", got.String(), want)
+	}
+}
+
+func Test_metricsHandler(t *testing.T) {
+	ms := newMetricsSet()
+	m := ms.get(config{cmd: "date"})
+	start := time.Unix(1792380000, 0)
+	m.record(result{start: start, duration: 20 * time.Millisecond})
+	m.record(result{start: start.Add(time.Minute), duration: 2 * time.Second, err: errors.New("not found")})
+
+	rec := httptest.NewRecorder()
+	newMetricsHandler(ms).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		"watchcmd_runs_total 2\n",
+		"watchcmd_failures_total 1\n",
+		"watchcmd_last_exit_code -1\n",
+		`watchcmd_run_duration_seconds_bucket{le="0.01"} 0` + "\n",
+		`watchcmd_run_duration_seconds_bucket{le="0.05"} 1` + "\n",
+		`watchcmd_run_duration_seconds_bucket{le="2.5"} 2` + "\n",
+		"watchcmd_run_duration_seconds_sum 2.02\n",
+		"watchcmd_last_success_timestamp_seconds 1792380000.02\n",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics does not contain %q:\n%s", want, rec.Body.String())
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	newMetricsHandler(ms).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if !strings.Contains(rec.Body.String(), `"status":"not found"`) {
+		t.Errorf("/status does not contain the last run: %s", rec.Body.String())
+	}
+}
+
+func Test_metricsHandlerJobs(t *testing.T) {
+	ms := newMetricsSet()
+	start := time.Unix(1792380000, 0)
+	ms.get(config{name: "pods", cmd: "kubectl get pods"}).record(result{start: start, duration: 20 * time.Millisecond})
+	ms.get(config{name: "disk", cmd: "df -h"})
+	removed := ms.get(config{name: "old", cmd: "date"})
+	removed.record(result{start: start, duration: time.Second})
+	ms.remove("old")
+
+	// a restarted job keeps counting
+	ms.get(config{name: "pods", cmd: "kubectl get pods -A"}).record(result{start: start.Add(time.Minute), duration: time.Second, err: errors.New("not found")})
+
+	rec := httptest.NewRecorder()
+	newMetricsHandler(ms).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`watchcmd_runs_total{job="disk"} 0` + "\n",
+		`watchcmd_runs_total{job="pods"} 2` + "\n",
+		`watchcmd_failures_total{job="pods"} 1` + "\n",
+		`watchcmd_last_exit_code{job="pods"} -1` + "\n",
+		`watchcmd_run_duration_seconds_bucket{job="pods",le="0.05"} 1` + "\n",
+		`watchcmd_run_duration_seconds_bucket{job="disk",le="+Inf"} 0` + "\n",
+		`watchcmd_last_success_timestamp_seconds{job="pods"} 1792380000.02` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics does not contain %q:\n%s", want, body)
+		}
+	}
+	for _, unwanted := range []string{`job="old"`, `watchcmd_last_exit_code{job="disk"}`} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("/metrics contains %q:\n%s", unwanted, body)
+		}
+	}
+	if n := strings.Count(body, "# TYPE watchcmd_runs_total counter\n"); n != 1 {
+		t.Errorf("/metrics has %d TYPE lines of watchcmd_runs_total", n)
+	}
+
+	rec = httptest.NewRecorder()
+	newMetricsHandler(ms).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var statuses []runStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("/status: %s: %s", err, rec.Body.String())
+	}
+	if len(statuses) != 2 || statuses[0].Job != "disk" || statuses[1].Job != "pods" || statuses[1].Command != "kubectl get pods -A" {
+		t.Errorf("/status = %s", rec.Body.String())
+	}
+}
+
+func Test_metricsLabels(t *testing.T) {
+	tests := []struct {
+		job  string
+		want string
+	}{
+		{"", `{le="0.5"}`},
+		{"pods", `{job="pods",le="0.5"}`},
+		{"поды", `{job="поды",le="0.5"}`},
+		{`say "hi"`, `{job="say \"hi\"",le="0.5"}`},
+		{`C:\dir`, `{job="C:\\dir",le="0.5"}`},
+		{"two\nlines", `{job="two\nlines",le="0.5"}`},
+		{"tab\there", "{job=\"tab\there\",le=\"0.5\"}"},
+	}
+
+	for _, tt := range tests {
+		m := newMetrics(config{name: tt.job})
+		if got := m.labels("le", "0.5"); got != tt.want {
+			t.Errorf("labels() of %q = %s, want %s", tt.job, got, tt.want)
+		}
+	}
+}
+
+// callbackWriter calls fn on every write
+type callbackWriter struct {
+	fn func()
+}
+
+func (w callbackWriter) Write(b []byte) (int, error) {
+	w.fn()
+	return len(b), nil
+}
+
+func Test_metricsWriteUnlocked(t *testing.T) {
+	ms := newMetricsSet()
+	m := ms.get(config{name: "pods", cmd: "kubectl get pods"})
+	m.record(result{duration: time.Second})
+
+	// a run finishes while a slow client reads the metrics
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ms.writePrometheus(callbackWriter{fn: func() { m.record(result{duration: time.Second}) }})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writePrometheus() holds the lock of the metrics while writing")
+	}
+	if got := m.status().Runs; got != 2 {
+		t.Errorf("runs = %d, want 2", got)
+	}
+}
+
+func Test_metricsStatusOutput(t *testing.T) {
+	m := newMetrics(config{cmd: "cat"})
+	if s := m.status(); s.LastOutput != nil {
+		t.Errorf("last output before the first run = %q", *s.LastOutput)
+	}
+
+	out := []byte("ok\n\xff\n")
+	m.record(result{output: out, duration: time.Second})
+	data, err := json.Marshal(m.status())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s struct {
+		LastRun struct {
+			Output []byte `json:"output"`
+		} `json:"last_run"`
+		LastOutput string `json:"last_output"`
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.LastOutput != "ok\n\uFFFD\n" {
+		t.Errorf("last_output = %q, want %q", s.LastOutput, "ok\n\uFFFD\n")
+	}
+	if !bytes.Equal(s.LastRun.Output, out) {
+		t.Errorf("last_run.output = %q, want %q", s.LastRun.Output, out)
+	}
+}
+
+func Test_jobConfig(t *testing.T) {
+	base := config{interval: 2 * time.Second, overlap: "skip", stderr: "stream", grace: 5 * time.Second}
+
+	cfg, err := jobConfig(base, "pods", jobSpec{Command: "kubectl get pods | grep -v Running", Schedule: "@hourly", Overlap: "queue"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.shell || commandLine(cfg) != "kubectl get pods | grep -v Running" || cfg.cron == nil || cfg.overlap != "queue" || cfg.grace != base.grace {
+		t.Errorf("jobConfig() = %+v", cfg)
+	}
+
+	for _, spec := range []jobSpec{
+		{},
+		{Command: "date", Interval: time.Second, Schedule: "@hourly"},
+		{Command: "date", Schedule: "0 0 30 2 *"},
+		{Command: "date", Overlap: "wait"},
+	} {
+		if _, err := jobConfig(base, "bad", spec); err == nil {
+			t.Errorf("jobConfig(%+v) succeeded, want error", spec)
+		}
+	}
+}
+
+func Test_prefixWriter(t *testing.T) {
+	var out strings.Builder
+	p := newPrefixWriter(&out, "job")
+	p.Write([]byte("one\ntw"))
+	p.Write([]byte("o\nthree"))
+	p.flush()
+	if want := "job | one\njob | two\njob | three\n"; out.String() != want {
+		t.Errorf("prefixWriter wrote %q, want %q", out.String(), want)
+	}
+}
+
+func Test_lineWriter(t *testing.T) {
+	var lines []string
+	lw := &lineWriter{fn: func(line []byte) { lines = append(lines, string(line)) }}
+	lw.Write([]byte("one\ntw"))
+	lw.Write([]byte("o\n\nthr"))
+	lw.Write([]byte("ee"))
+	lw.flush()
+	if got, want := strings.Join(lines, ","), "one,two,,three"; got != want {
+		t.Errorf("lineWriter passed %q, want %q", got, want)
+	}
+}
+
+func Test_changedRunes(t *testing.T) {
+	tests := []struct {
+		name string
+		prev []string
+		n    int
+		line string
+		want string
+	}{
+		{"first run", nil, 0, "abc", "..."},
+		{"same length", []string{"abc"}, 0, "abd", "..x"},
+		{"shorter", []string{"abcdef"}, 0, "abc", "..."},
+		{"longer", []string{"ab"}, 0, "abcd", "..xx"},
+		{"new line", []string{"a"}, 1, "xy", "xx"},
+		{"multi-byte runes", []string{"привет 日本語"}, 0, "привeт 日本人", "....x....x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got strings.Builder
+			for _, changed := range changedRunes(tt.prev, tt.n, []rune(tt.line)) {
+				if changed {
+					got.WriteByte('x')
+				} else {
+					got.WriteByte('.')
+				}
+			}
+			if got.String() != tt.want {
+				t.Errorf("changedRunes(%q, %q) = %s, want %s", tt.prev, tt.line, got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_screenHighlight(t *testing.T) {
+	on := func(s string) string { return highlightOn + s + resetStyle }
+	tests := []struct {
+		name string
+		diff diffMode
+		want string
+	}{
+		{"off", diffOff, "aX\ncY"},
+		// only the last change is highlighted
+		{"changes", diffChanges, "aX\nc" + on("Y")},
+		// the change of the second run is still highlighted after the third one
+		{"cumulative", diffCumulative, "a" + on("X") + "\nc" + on("Y")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			s := &screen{w: &out, tty: true, size: func() (int, int) { return 80, 24 }, noTitle: true, diff: tt.diff, changed: map[position]bool{}}
+			for _, run := range []string{"ab\ncd\n", "aX\ncd\n", "aX\ncY\n"} {
+				out.Reset()
+				s.show([]byte(run), "exit 0")
+			}
+			if got := strings.TrimPrefix(out.String(), clearScreen); got != tt.want {
+				t.Errorf("screen shows %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_screenHeader(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	right := "[exit 0] host: Mon Oct 19 12:00:00 2026"
+	tests := []struct {
+		name  string
+		title string
+		next  time.Time
+		width int
+		want  string
+	}{
+		{"padded", "Every 2.0s: date", time.Time{}, 60, "Every 2.0s: date     " + right},
+		{"exact", "Every 2.0s: date", time.Time{}, 56, "Every 2.0s: date " + right},
+		{"title truncated", "Every 2.0s: date", time.Time{}, 50, "Every 2.0s " + right},
+		{"multi-byte title truncated", "Каждые 2.0s: дата", time.Time{}, 50, "Каждые 2.0 " + right},
+		{"only title", "Every 2.0s: date", time.Time{}, 30, "Every 2.0s: date"},
+		{"only title truncated", "Every 2.0s: date", time.Time{}, 10, "Every 2.0s"},
+		{"next run", "At @hourly: date", now.Add(time.Hour), 89,
+			"At @hourly: date  [exit 0] next: Mon Oct 19 13:00:00 2026  host: Mon Oct 19 12:00:00 2026"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &screen{title: tt.title, hostname: "host", status: "exit 0", next: tt.next}
+			got := s.header(tt.width, now)
+			if got != tt.want {
+				t.Errorf("header(%d) = %q, want %q", tt.width, got, tt.want)
+			}
+			if n := utf8.RuneCountInString(got); n > tt.width {
+				t.Errorf("header(%d) is %d runes wide", tt.width, n)
+			}
+		})
+	}
+}
+
+func Test_truncate(t *testing.T) {
+	tests := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"abcdef", 3, "abc"},
+		{"abc", 3, "abc"},
+		{"abc", 10, "abc"},
+		{"abc", 0, ""},
+		{"日本語テキスト", 3, "日本語"},
+	}
+
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.width); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.width, got, tt.want)
+		}
+	}
+}
+
+func Test_expandTabs(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"no tabs", "no tabs"},
+		{"\tx", "        x"},
+		{"abc\tx", "abc     x"},
+		{"abcdefgh\tx", "abcdefgh        x"},
+		{"a\tb\tc", "a       b       c"},
+		{"日本\tx", "日本      x"},
+	}
+
+	for _, tt := range tests {
+		if got := expandTabs(tt.line); got != tt.want {
+			t.Errorf("expandTabs(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func Test_screenLeave(t *testing.T) {
+	var out strings.Builder
+	s := &screen{w: &out, tty: true, size: func() (int, int) { return 80, 24 }, noTitle: true, changed: map[position]bool{}}
+	s.leave()
+	if out.String() != "" {
+		t.Errorf("leave before the output writes %q", out.String())
+	}
+
+	s.show([]byte("output\n"), "exit 0")
+	out.Reset()
+	s.leave()
+	s.leave()
+	if out.String() != "\n" {
+		t.Errorf("leave writes %q, want a single newline", out.String())
+	}
+}
+
+func Test_runCmd(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        config
+		wantOutput string
+		wantStderr string
+		wantCode   int
+		wantStatus string
+	}{
+		{
+			name:       "exit status",
+			cfg:        config{cmd: "sh", args: []string{"-c", "echo out; exit 3"}},
+			wantOutput: "out\n",
+			wantCode:   3,
+			wantStatus: "exit 3",
+		},
+		{
+			name:       "stderr streamed",
+			cfg:        config{cmd: "sh", args: []string{"-c", "echo out; echo err >&2"}, stderr: "stream"},
+			wantOutput: "out\n",
+			wantStderr: "err\n",
+			wantStatus: "exit 0",
+		},
+		{
+			name:       "stderr merged",
+			cfg:        config{cmd: "sh", args: []string{"-c", "echo out; echo err >&2; echo out"}, stderr: "merge"},
+			wantOutput: "out\nerr\nout\n",
+			wantStatus: "exit 0",
+		},
+		{
+			name:       "direct exec",
+			cfg:        config{cmd: "echo", args: []string{"a", "|", "tr", "a", "x"}},
+			wantOutput: "a | tr a x\n",
+			wantStatus: "exit 0",
+		},
+		{
+			name:       "shell",
+			cfg:        config{cmd: "echo", args: []string{"a", "|", "tr", "a", "x"}, shell: true},
+			wantOutput: "x\n",
+			wantStatus: "exit 0",
+		},
+		{
+			name:       "signal",
+			cfg:        config{cmd: "kill -9 $$", shell: true},
+			wantCode:   -1,
+			wantStatus: "signal: killed",
+		},
+		{
+			name:       "not started",
+			cfg:        config{cmd: "/nonexistent/watchcmd-test"},
+			wantCode:   -1,
+			wantStatus: "fork/exec /nonexistent/watchcmd-test: no such file or directory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stderr := captureStderr(t)
+			tt.cfg.grace = time.Second
+			res := runCmd(context.Background(), tt.cfg, nil)
+
+			if string(res.output) != tt.wantOutput {
+				t.Errorf("output = %q, want %q", res.output, tt.wantOutput)
+			}
+			if got := stderr(); got != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", got, tt.wantStderr)
+			}
+			if res.exitCode() != tt.wantCode {
+				t.Errorf("exitCode() = %d, want %d", res.exitCode(), tt.wantCode)
+			}
+			if res.status() != tt.wantStatus {
+				t.Errorf("status() = %q, want %q", res.status(), tt.wantStatus)
+			}
+		})
+	}
+}
+
+// captureStderr redirects os.Stderr to a file until the test ends, the returned function reads what was written
+func captureStderr(t *testing.T) func() string {
+	f, err := os.CreateTemp(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stderr
+	os.Stderr = f
+	t.Cleanup(func() {
+		os.Stderr = orig
+		f.Close()
+	})
+
+	return func() string {
+		b, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+}
+
+func Test_configUntil(t *testing.T) {
+	exit2 := exec.Command("sh", "-c", "exit 2").Run()
+	if exit2 == nil {
+		t.Fatal("sh -c 'exit 2' succeeded")
+	}
+
+	tests := []struct {
+		name       string
+		cfg        config
+		res        result
+		changed    bool
+		wantDone   bool
+		wantReason string
+	}{
+		{"no conditions", config{untilExitCode: -1}, result{output: []byte("done")}, true, false, ""},
+		{"chgexit unchanged", config{chgexit: true, untilExitCode: -1}, result{}, false, false, ""},
+		{"chgexit changed", config{chgexit: true, untilExitCode: -1}, result{}, true, true, "output changed"},
+		{"regex not matched", config{untilRegex: regexp.MustCompile(`^ready$`), untilExitCode: -1},
+			result{output: []byte("starting\n")}, true, false, ""},
+		{"regex matched", config{untilRegex: regexp.MustCompile(`(?m)^ready$`), untilExitCode: -1},
+			result{output: []byte("starting\nready\n")}, false, true, `output matches "(?m)^ready$"`},
+		{"exit code not matched", config{untilExitCode: 2}, result{}, false, false, ""},
+		{"exit code zero", config{untilExitCode: 0}, result{}, false, true, "command exited with status 0"},
+		{"exit code matched", config{untilExitCode: 2}, result{err: exit2}, false, true, "command exited with status 2"},
+		{"not started", config{untilExitCode: 2}, result{err: errors.New("not found")}, false, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done, reason := tt.cfg.until(tt.res, tt.changed)
+			if done != tt.wantDone || reason != tt.wantReason {
+				t.Errorf("until() = %v, %q, want %v, %q", done, reason, tt.wantDone, tt.wantReason)
+			}
+		})
+	}
+}
+
+func Test_nextAfter(t *testing.T) {
+	base := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		sched      schedule
+		prev       time.Time
+		now        time.Time
+		want       time.Time
+		wantMissed int
+	}{
+		{"interval on time", intervalSchedule{interval: 10 * time.Second}, base, base.Add(time.Millisecond), base.Add(10 * time.Second), 0},
+		{"interval exactly at next", intervalSchedule{interval: 10 * time.Second}, base, base.Add(10 * time.Second), base.Add(10 * time.Second), 0},
+		{"interval late", intervalSchedule{interval: 10 * time.Second}, base, base.Add(35 * time.Second), base.Add(40 * time.Second), 3},
+		{"interval keeps the phase", intervalSchedule{interval: 10 * time.Second}, base.Add(3 * time.Second), base.Add(25 * time.Second), base.Add(33 * time.Second), 2},
+		{"precise aligns", preciseSchedule{interval: 10 * time.Second}, base.Add(3 * time.Second), base.Add(4 * time.Second), base.Add(10 * time.Second), 0},
+		{"precise late", preciseSchedule{interval: 10 * time.Second}, base.Add(3 * time.Second), base.Add(31 * time.Second), base.Add(40 * time.Second), 3},
+		{"precise suspended", preciseSchedule{interval: time.Minute}, base, base.Add(time.Hour + time.Second), base.Add(61 * time.Minute), 60},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, missed := nextAfter(tt.sched, tt.prev, tt.now)
+			if !next.Equal(tt.want) || missed != tt.wantMissed {
+				t.Errorf("nextAfter() = %s, %d, want %s, %d", next.Format(time.TimeOnly), missed, tt.want.Format(time.TimeOnly), tt.wantMissed)
+			}
+		})
+	}
+}
+
+func Test_preciseSchedule(t *testing.T) {
+	moscow, err1 := time.LoadLocation("Europe/Moscow")
+	kathmandu, err2 := time.LoadLocation("Asia/Kathmandu")
+	newYork, err3 := time.LoadLocation("America/New_York")
+	if err := errors.Join(err1, err2, err3); err != nil {
+		t.Skip(err)
+	}
+
+	base := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		interval time.Duration
+		loc      *time.Location
+		prev     time.Time
+		want     time.Time
+	}{
+		{10 * time.Second, nil, base, base.Add(10 * time.Second)},
+		{10 * time.Second, nil, base.Add(9*time.Second + 999*time.Millisecond), base.Add(10 * time.Second)},
+		{10 * time.Second, nil, base.Add(10 * time.Second), base.Add(20 * time.Second)},
+		{time.Minute, nil, base.Add(59 * time.Second), base.Add(time.Minute)},
+		{time.Hour, nil, base.Add(90 * time.Minute), base.Add(2 * time.Hour)},
+		// 15:00 in Moscow is followed by 18:00 in Moscow, not by 18:00 UTC
+		{6 * time.Hour, moscow, base, base.Add(3 * time.Hour)},
+		{6 * time.Hour, time.UTC, base, base.Add(6 * time.Hour)},
+		// the zone is +05:45, so the hours start at :15 UTC
+		{time.Hour, kathmandu, base, base.Add(15 * time.Minute)},
+		{10 * time.Second, kathmandu, base, base.Add(10 * time.Second)},
+		// local midnights around the start of daylight saving time, the day is 23 hours long
+		{24 * time.Hour, newYork, time.Date(2026, 3, 7, 5, 0, 0, 0, time.UTC), time.Date(2026, 3, 8, 5, 0, 0, 0, time.UTC)},
+		{24 * time.Hour, newYork, time.Date(2026, 3, 8, 5, 0, 0, 0, time.UTC), time.Date(2026, 3, 9, 4, 0, 0, 0, time.UTC)},
+		{time.Hour, newYork, time.Date(2026, 3, 8, 6, 0, 0, 0, time.UTC), time.Date(2026, 3, 8, 7, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		s := preciseSchedule{interval: tt.interval, loc: tt.loc}
+		if got := s.next(tt.prev); !got.Equal(tt.want) {
+			t.Errorf("next(%s) every %s in %v = %s, want %s", tt.prev.Format(time.RFC3339), tt.interval, tt.loc, got.UTC().Format(time.RFC3339), tt.want.Format(time.RFC3339))
+		}
+	}
+}
+
+func Test_configLocation(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  config
+		want *time.Location
+	}{
+		{"default", config{}, time.Local},
+		{"default with schedule", config{schedule: "0 4 * * *"}, time.Local},
+		{"utc", config{timezone: "UTC", schedule: "0 4 * * *"}, time.UTC},
+		{"zone", config{timezone: "Europe/Moscow", precise: true}, moscow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.parseCron(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.cfg.location.String() != tt.want.String() {
+				t.Errorf("location = %s, want %s", tt.cfg.location, tt.want)
+			}
+			if cron, ok := tt.cfg.cron.(*cronSchedule); ok && cron.loc != tt.cfg.location {
+				t.Errorf("schedule location = %s, want %s", cron.loc, tt.cfg.location)
+			}
+			if s, ok := newSchedule(tt.cfg).(preciseSchedule); ok && s.loc != tt.cfg.location {
+				t.Errorf("precise location = %s, want %s", s.loc, tt.cfg.location)
+			}
+		})
+	}
+
+	cfg := config{timezone: "Nowhere/Atlantis"}
+	if err := cfg.parseCron(); err == nil {
+		t.Error("parseCron() with unknown zone error = nil")
+	}
+}
+
+func Test_overlapPolicies(t *testing.T) {
+	tests := []struct {
+		overlap     string
+		wantRunning int
+		wantQueued  int
+		wantSkipped int
+		// wantAfter is the amount of runs started when the run in progress finishes
+		wantAfter int
+	}{
+		{"skip", 1, 0, 3, 0},
+		{"queue", 1, 1, 2, 1},
+		{"parallel", 4, 0, 0, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.overlap, func(t *testing.T) {
+			ctx := context.Background()
+			scr := &screen{w: io.Discard, tty: true, size: func() (int, int) { return 80, 24 }, changed: map[position]bool{}}
+			w := newWatcher(config{cmd: "true", overlap: tt.overlap, untilExitCode: -1}, scr, nil, nil)
+			// the first run is in progress
+			w.seq, w.running = 1, 1
+
+			for i := 0; i < 3; i++ {
+				w.tick(ctx, 0)
+			}
+			if w.running != tt.wantRunning || w.queued != tt.wantQueued || w.skipped != tt.wantSkipped {
+				t.Errorf("running %d, queued %d, skipped %d, want %d, %d, %d",
+					w.running, w.queued, w.skipped, tt.wantRunning, tt.wantQueued, tt.wantSkipped)
+			}
+
+			if _, err := w.done(ctx, finished{seq: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if w.running != tt.wantAfter || w.queued != 0 {
+				t.Errorf("after the run: running %d, queued %d, want %d, 0", w.running, w.queued, tt.wantAfter)
+			}
+			w.wait()
+		})
+	}
+}
+
+func Test_historyOutput(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.jsonl")
+	hist, err := openHistory(config{cmd: "cat", history: file, historyOutput: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := [][]byte{[]byte("caf\xe9\n\xff\xfe\n"), nil}
+	for _, out := range outputs {
+		if err := hist.add(result{output: out}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hist.close()
+
+	for i, want := range outputs {
+		var got bytes.Buffer
+		if err := runHistory([]string{"-file", file, "show", strconv.Itoa(i + 1)}, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("history show %d = %q, want %q", i+1, got.Bytes(), want)
+		}
+	}
+
+	records, err := readHistory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0].OutputHash != outputHash(*records[0].Output) {
+		t.Errorf("output_hash %s does not match the recorded output", records[0].OutputHash)
+	}
+	if records[1].Output == nil {
+		t.Error("empty output is not recorded")
+	}
+}
+
+func Test_listHistory(t *testing.T) {
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	records := []historyRecord{
+		{Job: "pods", Command: "kubectl get pods", Start: start, Status: "exit 0", OutputHash: "sha256:aaaa"},
+		{Job: "disk", Command: "df -h", Start: start, Status: "exit 0", OutputHash: "sha256:bbbb"},
+		{Job: "pods", Command: "kubectl get pods", Start: start, Status: "exit 0", OutputHash: "sha256:aaaa"},
+		{Job: "disk", Command: "df -h", Start: start, Status: "exit 0", OutputHash: "sha256:cccc"},
+		{Job: "pods", Command: "kubectl get pods", Start: start, Status: "exit 0", OutputHash: "sha256:aaaa"},
+	}
+
+	var got strings.Builder
+	if err := listHistory(&got, records); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(got.String(), "\n"), "\n")
+	if len(lines) != len(records)+1 {
+		t.Fatalf("listHistory() =\n%s", got.String())
+	}
+	// only the second run of disk changed
+	for i, line := range lines[1:] {
+		if changed := strings.Contains(line, " *"); changed != (i == 3) {
+			t.Errorf("run %d is marked changed: %v\n%s", i+1, changed, got.String())
+		}
+	}
+}
+
+func Test_watchFilesPolling(t *testing.T) {
+	for _, period := range []time.Duration{0, 50 * time.Millisecond} {
+		t.Run(fmt.Sprintf("debounce %s", period), func(t *testing.T) {
+			dir, outside := t.TempDir(), t.TempDir()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cfg := config{watch: patterns{dir}, forcePoll: true, poll: 20 * time.Millisecond, debounce: period}
+			changes := watchFiles(ctx, cfg)
+
+			select {
+			case <-changes:
+				t.Fatal("change reported before the files changed")
+			case <-time.After(200 * time.Millisecond):
+			}
+
+			// the file is moved in, so the poll never sees it partially written
+			name := filepath.Join(outside, "a.txt")
+			if err := os.WriteFile(name, []byte("content"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(name, filepath.Join(dir, "a.txt")); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-changes:
+			case <-time.After(2 * time.Second):
+				t.Fatal("change is not reported")
+			}
+			select {
+			case <-changes:
+				t.Fatal("change reported twice")
+			case <-time.After(200 * time.Millisecond):
+			}
+		})
+	}
+}
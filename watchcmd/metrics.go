@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds of watchcmd_run_duration_seconds buckets in seconds
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// metrics holds the statistics of the runs, it is updated from the repeat loop and read by the HTTP handlers
+type metrics struct {
+	mu sync.Mutex
+	// job is the name of the job in -config mode, it is the job label of the series
+	job     string
+	command string
+
+	runs     int
+	failures int
+	// buckets holds the amount of runs which are not longer than the bound of the bucket, not cumulative
+	buckets     []int
+	durationSum float64
+	last        result
+	lastSuccess time.Time
+}
+
+func newMetrics(cfg config) *metrics {
+	return &metrics{job: cfg.name, command: commandLine(cfg), buckets: make([]int, len(durationBuckets))}
+}
+
+// metricsSet holds the metrics of the command or of every job of the -config file, they are served together
+type metricsSet struct {
+	mu   sync.Mutex
+	jobs map[string]*metrics
+}
+
+func newMetricsSet() *metricsSet {
+	return &metricsSet{jobs: map[string]*metrics{}}
+}
+
+// get returns the metrics of the job, a job restarted after the config is reloaded keeps counting.
+// It returns nil if the metrics are not served.
+func (s *metricsSet) get(cfg config) *metrics {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.jobs[cfg.name]
+	if !ok {
+		m = newMetrics(cfg)
+		s.jobs[cfg.name] = m
+		return m
+	}
+	m.mu.Lock()
+	m.command = commandLine(cfg)
+	m.mu.Unlock()
+	return m
+}
+
+// remove drops the series of the job removed from the config
+func (s *metricsSet) remove(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, name)
+}
+
+// sorted returns the metrics ordered by the job name
+func (s *metricsSet) sorted() []*metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := make([]*metrics, 0, len(s.jobs))
+	for _, m := range s.jobs {
+		all = append(all, m)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].job < all[j].job })
+	return all
+}
+
+// record updates the metrics with the finished run, it does nothing if the metrics are not served
+func (m *metrics) record(res result) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.runs++
+	if res.failed() {
+		m.failures++
+	} else {
+		m.lastSuccess = res.start.Add(res.duration)
+	}
+
+	seconds := res.duration.Seconds()
+	m.durationSum += seconds
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			m.buckets[i]++
+			break
+		}
+	}
+	m.last = res
+}
+
+// writePrometheus writes the metrics in the Prometheus text format, the series of every job have the job label.
+// The metrics are rendered into a buffer, so a slow client does not hold the locks and block the runs.
+func (s *metricsSet) writePrometheus(w io.Writer) {
+	var buf bytes.Buffer
+	s.render(&buf)
+	w.Write(buf.Bytes())
+}
+
+// render writes a consistent snapshot of the metrics of all jobs
+func (s *metricsSet) render(w io.Writer) {
+	all := s.sorted()
+	for _, m := range all {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	}
+
+	family := func(name, typ, help string, write func(m *metrics)) {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+		for _, m := range all {
+			write(m)
+		}
+	}
+	// ran leaves out the series of the jobs which have not run yet
+	ran := func(write func(m *metrics)) func(m *metrics) {
+		return func(m *metrics) {
+			if m.runs > 0 {
+				write(m)
+			}
+		}
+	}
+
+	family("watchcmd_runs_total", "counter", "Number of finished runs of the command.", func(m *metrics) {
+		fmt.Fprintf(w, "watchcmd_runs_total%s %d\n", m.labels(), m.runs)
+	})
+	family("watchcmd_failures_total", "counter", "Number of runs which exited with non-zero status, timed out or could not start.", func(m *metrics) {
+		fmt.Fprintf(w, "watchcmd_failures_total%s %d\n", m.labels(), m.failures)
+	})
+
+	if anyMetrics(all, func(m *metrics) bool { return m.runs > 0 }) {
+		family("watchcmd_last_exit_code", "gauge", "Exit status of the last run, -1 if it was killed by a signal or could not start.", ran(func(m *metrics) {
+			fmt.Fprintf(w, "watchcmd_last_exit_code%s %d\n", m.labels(), m.last.exitCode())
+		}))
+		family("watchcmd_last_duration_seconds", "gauge", "Duration of the last run.", ran(func(m *metrics) {
+			fmt.Fprintf(w, "watchcmd_last_duration_seconds%s %s\n", m.labels(), formatFloat(m.last.duration.Seconds()))
+		}))
+	}
+
+	family("watchcmd_run_duration_seconds", "histogram", "Duration of the runs.", func(m *metrics) {
+		cumulative := 0
+		for i, bound := range durationBuckets {
+			cumulative += m.buckets[i]
+			fmt.Fprintf(w, "watchcmd_run_duration_seconds_bucket%s %d\n", m.labels("le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "watchcmd_run_duration_seconds_bucket%s %d\n", m.labels("le", "+Inf"), m.runs)
+		fmt.Fprintf(w, "watchcmd_run_duration_seconds_sum%s %s\n", m.labels(), formatFloat(m.durationSum))
+		fmt.Fprintf(w, "watchcmd_run_duration_seconds_count%s %d\n", m.labels(), m.runs)
+	})
+
+	if anyMetrics(all, func(m *metrics) bool { return !m.lastSuccess.IsZero() }) {
+		family("watchcmd_last_success_timestamp_seconds", "gauge", "Unix time when the last successful run finished.", func(m *metrics) {
+			if !m.lastSuccess.IsZero() {
+				fmt.Fprintf(w, "watchcmd_last_success_timestamp_seconds%s %s\n", m.labels(), formatFloat(float64(m.lastSuccess.UnixMilli())/1000))
+			}
+		})
+	}
+}
+
+// labels formats the job label and the label pairs for a series, e.g. {job="pods",le="0.5"}
+func (m *metrics) labels(pairs ...string) string {
+	if m.job != "" {
+		pairs = append([]string{"job", m.job}, pairs...)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// labelEscaper escapes a label value like the Prometheus text format requires, other characters including
+// non-ASCII ones are written as is
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func anyMetrics(all []*metrics, f func(m *metrics) bool) bool {
+	for _, m := range all {
+		if f(m) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// runStatus is the response of /status
+type runStatus struct {
+	Job         string         `json:"job,omitempty"`
+	Command     string         `json:"command"`
+	Runs        int            `json:"runs"`
+	Failures    int            `json:"failures"`
+	LastRun     *historyRecord `json:"last_run"`
+	LastSuccess *time.Time     `json:"last_success"`
+	// LastOutput is the output of the last run as text, invalid UTF-8 is replaced with U+FFFD,
+	// the exact output is in last_run.output in base64
+	LastOutput *string `json:"last_output"`
+}
+
+func (m *metrics) status() runStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := runStatus{Job: m.job, Command: m.command, Runs: m.runs, Failures: m.failures}
+	if m.runs > 0 {
+		rec := newHistoryRecord(m.command, m.last, true)
+		rec.Job = m.job
+		s.LastRun = &rec
+		out := strings.ToValidUTF8(string(m.last.output), "\uFFFD")
+		s.LastOutput = &out
+	}
+	if !m.lastSuccess.IsZero() {
+		lastSuccess := m.lastSuccess
+		s.LastSuccess = &lastSuccess
+	}
+	return s
+}
+
+// status returns the status of the command or the list of the statuses of the jobs in -config mode
+func (s *metricsSet) status() any {
+	all := s.sorted()
+	if len(all) == 1 && all[0].job == "" {
+		return all[0].status()
+	}
+	statuses := make([]runStatus, 0, len(all))
+	for _, m := range all {
+		statuses = append(statuses, m.status())
+	}
+	return statuses
+}
+
+type metricsHandler struct {
+	metrics *metricsSet
+	mux     *http.ServeMux
+}
+
+// newMetricsHandler serves the metrics in the Prometheus text format on /metrics and the last run on /status
+func newMetricsHandler(m *metricsSet) *metricsHandler {
+	h := &metricsHandler{
+		metrics: m,
+		mux:     http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/metrics", h.handleMetrics)
+	h.mux.HandleFunc("/status", h.handleStatus)
+
+	return h
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *metricsHandler) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	h.metrics.writePrometheus(w)
+}
+
+func (h *metricsHandler) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.metrics.status())
+}
+
+// serveMetrics listens on addr before returning, so a busy port is reported at the start,
+// and serves the metrics until stop is called
+func serveMetrics(addr string, m *metricsSet) (stop func(), err error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen metrics: %w", err)
+	}
+
+	srv := &http.Server{Handler: newMetricsHandler(m), ReadHeaderTimeout: 5 * time.Second}
+	go srv.Serve(ln)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}, nil
+}
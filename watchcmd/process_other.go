@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op, there are no process groups to signal, so only the command itself is stopped
+func setProcessGroup(c *exec.Cmd) {}
+
+func terminateGroup(c *exec.Cmd) error {
+	return c.Process.Kill()
+}
+
+func killGroup(c *exec.Cmd) error {
+	return c.Process.Kill()
+}
@@ -0,0 +1,115 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_runCmdTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		// the command starts sleep in the background and prints its pid
+		cmd string
+		// minimum is how long the run takes at least
+		minimum time.Duration
+	}{
+		{"terminated", "sleep 30 & echo $!; wait", 0},
+		// the shell and sleep ignore SIGTERM, so they are killed after the grace period
+		{"killed", "trap '' TERM; sleep 30 & echo $!; wait", 300 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config{cmd: tt.cmd, shell: true, timeout: 200 * time.Millisecond, grace: 300 * time.Millisecond}
+			res := runCmd(context.Background(), cfg, nil)
+
+			if res.status() != "timeout 200ms" {
+				t.Errorf("status() = %q, want %q", res.status(), "timeout 200ms")
+			}
+			if res.duration < cfg.timeout+tt.minimum || res.duration > 5*time.Second {
+				t.Errorf("run took %s", res.duration)
+			}
+
+			pid, err := strconv.Atoi(strings.TrimSpace(string(res.output)))
+			if err != nil {
+				t.Fatalf("no pid in the output %q", res.output)
+			}
+			// the signal may take a moment to be delivered
+			for deadline := time.Now().Add(time.Second); processRunning(pid); time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					syscall.Kill(pid, syscall.SIGKILL)
+					t.Fatalf("child %d is still running", pid)
+				}
+			}
+		})
+	}
+}
+
+// processRunning reports whether the process exists and is not a zombie waiting to be reaped by init
+func processRunning(pid int) bool {
+	if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+		return false
+	}
+	out, err := exec.Command("ps", "-o", "stat=", "-p", strconv.Itoa(pid)).Output()
+	return err == nil && !strings.HasPrefix(strings.TrimSpace(string(out)), "Z")
+}
+
+func Test_runHookStopped(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// cancel is when the context is cancelled like on SIGINT, 0 does not cancel it
+		cancel  time.Duration
+		wantErr string
+	}{
+		{"shutdown", 0, 200 * time.Millisecond, "run hook: signal: terminated"},
+		{"timeout", 200 * time.Millisecond, 0, "run hook: timeout 200ms"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pidFile := filepath.Join(t.TempDir(), "pid")
+			cfg := config{onChange: "sleep 30 & echo $! > " + pidFile + "; wait", hookTimeout: tt.timeout, grace: 300 * time.Millisecond}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel > 0 {
+				time.AfterFunc(tt.cancel, cancel)
+			}
+
+			start := time.Now()
+			err := runHook(ctx, cfg, []byte("old"), []byte("new"))
+			if took := time.Since(start); took > 5*time.Second {
+				t.Errorf("hook took %s", took)
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("runHook() = %v, want %q", err, tt.wantErr)
+			}
+
+			data, err := os.ReadFile(pidFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil {
+				t.Fatalf("no pid in %q", data)
+			}
+			for deadline := time.Now().Add(time.Second); processRunning(pid); time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					syscall.Kill(pid, syscall.SIGKILL)
+					t.Fatalf("child %d of the hook is still running", pid)
+				}
+			}
+		})
+	}
+}
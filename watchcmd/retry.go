@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// backoff returns the delay before the retry number attempt (starting from 0): -backoff-initial doubled on every
+// attempt up to -backoff-max. The delay is randomly changed by up to -jitter of it, so the retries of several
+// watchcmd processes do not hit a failing service at the same moment.
+func backoff(cfg config, attempt int) time.Duration {
+	d := cfg.backoffInitial
+	for i := 0; i < attempt && d < cfg.backoffMax; i++ {
+		d *= 2
+	}
+	if d > cfg.backoffMax {
+		d = cfg.backoffMax
+	}
+	if cfg.jitter > 0 {
+		d += time.Duration(float64(d) * cfg.jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// failed handles a failed run: it schedules a retry if there are retries left and the next regular run is not sooner,
+// or opens the circuit breaker after -breaker consecutive failures. It reports whether the run is going to be retried
+// and describes what happens next for the log.
+func (w *watcher) failed() (bool, string) {
+	w.failures++
+	if w.cfg.breaker > 0 && w.failures >= w.cfg.breaker {
+		w.stopRetry()
+		w.pausedUntil = time.Now().Add(w.cfg.breakerPause)
+		w.pauses++
+		return false, fmt.Sprintf("%d consecutive failures, runs are paused until %s", w.failures, w.pausedUntil.Format(time.RFC3339))
+	}
+
+	if w.attempt >= w.cfg.retries {
+		return false, ""
+	}
+	delay := backoff(w.cfg, w.attempt)
+	retryAt := time.Now().Add(delay)
+	if !w.next.IsZero() && !retryAt.Before(w.next) {
+		return false, "the next run is sooner than the retry"
+	}
+
+	w.stopRetry()
+	w.retryTimer = time.NewTimer(delay)
+	w.retry = w.retryTimer.C
+	w.retryAt = retryAt
+	return true, fmt.Sprintf("retry %d/%d in %s", w.attempt+1, w.cfg.retries, delay.Round(time.Millisecond))
+}
+
+// retried starts the scheduled retry, unless another run is in progress
+func (w *watcher) retried(ctx context.Context) {
+	w.retry, w.retryTimer = nil, nil
+	if w.running > 0 && w.cfg.overlap != "parallel" {
+		return
+	}
+	w.attempt++
+	w.retries++
+	w.start(ctx)
+}
+
+// succeeded resets the retries and closes the circuit breaker
+func (w *watcher) succeeded() {
+	w.failures = 0
+	w.attempt = 0
+	w.pausedUntil = time.Time{}
+}
+
+func (w *watcher) stopRetry() {
+	if w.retryTimer != nil {
+		w.retryTimer.Stop()
+	}
+	w.retry, w.retryTimer = nil, nil
+}
+
+// paused reports whether the circuit breaker is open. The first run after the pause is a trial:
+// if it fails the breaker opens again, since the consecutive failures are only reset by a successful run.
+func (w *watcher) paused() bool {
+	if w.pausedUntil.IsZero() || !time.Now().Before(w.pausedUntil) {
+		return false
+	}
+	w.skipped++
+	if !w.scr.tty {
+		w.log.Printf("runs are paused until %s, skipped", w.pausedUntil.Format(time.RFC3339))
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package main
+
+import "time"
+
+var overlapPolicies = []string{"skip", "queue", "parallel"}
+
+// schedule decides when the command runs
+type schedule interface {
+	// next returns the time of the run following the one scheduled at prev
+	next(prev time.Time) time.Time
+}
+
+// intervalSchedule runs the command every interval counting from the first run, like time.Ticker
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+func (s intervalSchedule) next(prev time.Time) time.Time {
+	return prev.Add(s.interval)
+}
+
+// preciseSchedule runs the command at wall-clock multiples of interval in loc, e.g. at :00, :10, :20 seconds for 10s
+// or at 00:00, 06:00, 12:00 and 18:00 for 6h. UTC is used if loc is nil.
+type preciseSchedule struct {
+	interval time.Duration
+	loc      *time.Location
+}
+
+func (s preciseSchedule) next(prev time.Time) time.Time {
+	loc := s.loc
+	if loc == nil {
+		loc = time.UTC
+	}
+	// Truncate aligns to multiples since the zero time in UTC, so the time is shifted by the zone offset
+	_, offset := prev.In(loc).Zone()
+	shift := time.Duration(offset) * time.Second
+	next := prev.Add(shift).Truncate(s.interval).Add(s.interval).Add(-shift)
+
+	// the offset changes on a daylight saving time transition, the wall clock time is kept if it is still ahead
+	if _, nextOffset := next.In(loc).Zone(); nextOffset != offset {
+		if kept := next.Add(time.Duration(offset-nextOffset) * time.Second); kept.After(prev) {
+			next = kept
+		}
+	}
+	return next
+}
+
+func newSchedule(cfg config) schedule {
+	if cfg.cron != nil {
+		return cfg.cron
+	}
+	if cfg.precise {
+		return preciseSchedule{interval: cfg.interval, loc: cfg.location}
+	}
+	return intervalSchedule{interval: cfg.interval}
+}
+
+// nextAfter returns the first time scheduled after prev which is not in the past yet
+// and the amount of the scheduled times which have already passed, e.g. while the machine was suspended
+func nextAfter(s schedule, prev, now time.Time) (time.Time, int) {
+	missed := 0
+	next := s.next(prev)
+	for next.Before(now) {
+		missed++
+		next = s.next(next)
+	}
+	return next, missed
+}
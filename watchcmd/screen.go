@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	clearScreen = "\033[H\033[2J"
+	highlightOn = "\033[7m"
+	resetStyle  = "\033[0m"
+
+	headerTime = "Mon Jan _2 15:04:05 2006"
+	lineTime   = "15:04:05.000"
+)
+
+// diffMode is the value of -d flag, it can be used without a value like `watch -d`
+type diffMode string
+
+const (
+	diffOff        diffMode = ""
+	diffChanges    diffMode = "changes"
+	diffCumulative diffMode = "cumulative"
+)
+
+func (d *diffMode) String() string {
+	return string(*d)
+}
+
+func (d *diffMode) Set(value string) error {
+	switch value {
+	case "true", string(diffChanges):
+		*d = diffChanges
+	case "false":
+		*d = diffOff
+	case string(diffCumulative):
+		*d = diffCumulative
+	default:
+		return fmt.Errorf("must be %s or %s", diffChanges, diffCumulative)
+	}
+	return nil
+}
+
+func (d *diffMode) IsBoolFlag() bool {
+	return true
+}
+
+// position is a rune of the output addressed by its line and its index in the line
+type position struct {
+	line, col int
+}
+
+// screen shows the output of every run. On a terminal it works like procps watch: the screen is cleared before
+// every run, the header with the interval, the command, the hostname and the current time is shown on top
+// and the output is truncated to the terminal size. Otherwise the output of every run is just appended.
+type screen struct {
+	w        io.Writer
+	tty      bool
+	size     func() (width, height int)
+	title    string
+	hostname string
+	noTitle  bool
+	diff     diffMode
+	// stream shows the lines while the command is running, timestamps and separator only change the appended output
+	stream     bool
+	timestamps bool
+	separator  bool
+
+	cur []string
+	// live holds the lines of the running command on a terminal, it is shown instead of cur until the run is done
+	live   []string
+	prev   []string
+	status string
+	// next is the time of the next run, it is shown only if it is set
+	next time.Time
+	// changed holds every position which has ever changed, it is only used in cumulative mode
+	changed map[position]bool
+	// drawn is set when the cursor is left after the output on a terminal
+	drawn bool
+}
+
+func newScreen(f *os.File, cfg config) *screen {
+	hostname, _ := os.Hostname()
+	return &screen{
+		w:   f,
+		tty: isTerminal(f),
+		size: func() (int, int) {
+			if width, height, ok := terminalSize(f); ok {
+				return width, height
+			}
+			return 80, 24
+		},
+		title:      title(cfg),
+		hostname:   hostname,
+		noTitle:    cfg.noTitle,
+		diff:       cfg.diff,
+		stream:     cfg.stream,
+		timestamps: cfg.timestamps,
+		separator:  cfg.separator,
+		changed:    map[position]bool{},
+	}
+}
+
+// show displays the output of a new run, status describes how the command exited
+func (s *screen) show(out []byte, status string) {
+	if !s.tty {
+		// the streamed output is already written
+		if !s.stream {
+			s.w.Write(out)
+		}
+		if p, ok := s.w.(*prefixWriter); ok {
+			p.flush()
+		}
+		return
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	for i := range lines {
+		lines[i] = expandTabs(lines[i])
+	}
+	s.prev, s.cur = s.cur, lines
+	s.live = nil
+	s.status = status
+
+	if s.diff == diffCumulative {
+		for n, line := range s.cur {
+			for col, changed := range changedRunes(s.prev, n, []rune(line)) {
+				if changed {
+					s.changed[position{line: n, col: col}] = true
+				}
+			}
+		}
+	}
+
+	s.redraw()
+}
+
+// streamLine appends a line of the running command to the output, it is called from the goroutine of the run
+func (s *screen) streamLine(line []byte) {
+	var buf bytes.Buffer
+	if s.timestamps {
+		buf.WriteString(time.Now().Format(lineTime))
+		buf.WriteByte(' ')
+	}
+	buf.Write(line)
+	buf.WriteByte('\n')
+	s.w.Write(buf.Bytes())
+}
+
+// liveLine adds a line of the running command to the terminal, the screen is redrawn by the caller
+func (s *screen) liveLine(line string) {
+	s.live = append(s.live, expandTabs(line))
+}
+
+// runSeparator separates the appended output of the runs
+func (s *screen) runSeparator(seq int, start time.Time) {
+	if s.tty || !s.separator {
+		return
+	}
+	fmt.Fprintf(s.w, "--- run %d at %s ---\n", seq, start.Format(time.DateTime))
+}
+
+// redraw renders the output of the last run again, e.g. after the terminal is resized
+func (s *screen) redraw() {
+	if !s.tty {
+		return
+	}
+
+	width, height := s.size()
+	var buf bytes.Buffer
+	buf.WriteString(clearScreen)
+	if !s.noTitle {
+		buf.WriteString(s.header(width, time.Now()))
+		buf.WriteString("\n\n")
+		height -= 2
+	}
+
+	// while the command is running its lines are compared with the last run
+	lines, prev := s.cur, s.prev
+	if s.live != nil {
+		lines, prev = s.live, s.cur
+	}
+	for n, line := range lines {
+		if n >= height {
+			break
+		}
+		if n > 0 {
+			buf.WriteByte('\n')
+		}
+		s.highlight(&buf, n, line, prev, width)
+	}
+	s.w.Write(buf.Bytes())
+	s.drawn = true
+}
+
+// leave moves the cursor below the output on a terminal, so the messages written on exit start on a new line
+func (s *screen) leave() {
+	if !s.tty || !s.drawn {
+		return
+	}
+	s.w.Write([]byte("\n"))
+	s.drawn = false
+}
+
+// header returns the title on the left and the exit status, the hostname and the time now on the right,
+// fitted into width
+func (s *screen) header(width int, now time.Time) string {
+	right := fmt.Sprintf("%s: %s", s.hostname, now.Format(headerTime))
+	if !s.next.IsZero() {
+		right = fmt.Sprintf("next: %s  %s", s.next.Format(headerTime), right)
+	}
+	if s.status != "" {
+		right = fmt.Sprintf("[%s] %s", s.status, right)
+	}
+	left := []rune(s.title)
+	space := width - utf8.RuneCountInString(right) - 1
+	if space <= 0 {
+		return truncate(s.title, width)
+	}
+	if len(left) > space {
+		left = left[:space]
+	}
+	return string(left) + strings.Repeat(" ", space-len(left)+1) + right
+}
+
+func title(cfg config) string {
+	if cfg.schedule != "" {
+		return fmt.Sprintf("At %s: %s", cfg.schedule, commandLine(cfg))
+	}
+	if cfg.interval == 0 {
+		return fmt.Sprintf("On changes of %s: %s", strings.Join(cfg.watch, " "), commandLine(cfg))
+	}
+	return fmt.Sprintf("Every %.1fs: %s", cfg.interval.Seconds(), commandLine(cfg))
+}
+
+// beep rings the terminal bell
+func (s *screen) beep() {
+	if s.tty {
+		s.w.Write([]byte("\a"))
+	}
+}
+
+// highlight writes the first width runes of the line with the runes changed since prev in reverse video
+func (s *screen) highlight(buf *bytes.Buffer, n int, line string, prev []string, width int) {
+	runes := []rune(line)
+	var diff []bool
+	if s.diff == diffChanges {
+		diff = changedRunes(prev, n, runes)
+	}
+
+	on := false
+	for col, r := range runes {
+		if col >= width {
+			break
+		}
+
+		changed := false
+		switch s.diff {
+		case diffChanges:
+			changed = diff[col]
+		case diffCumulative:
+			changed = s.changed[position{line: n, col: col}]
+		}
+
+		if changed != on {
+			if changed {
+				buf.WriteString(highlightOn)
+			} else {
+				buf.WriteString(resetStyle)
+			}
+			on = changed
+		}
+		buf.WriteRune(r)
+	}
+	if on {
+		buf.WriteString(resetStyle)
+	}
+}
+
+// changedRunes reports which runes of the line n differ from the same line of the previous run.
+// Nothing is changed on the first run.
+func changedRunes(prevLines []string, n int, line []rune) []bool {
+	changed := make([]bool, len(line))
+	if prevLines == nil {
+		return changed
+	}
+
+	var prev []rune
+	if n < len(prevLines) {
+		prev = []rune(prevLines[n])
+	}
+	for col, r := range line {
+		changed[col] = col >= len(prev) || prev[col] != r
+	}
+	return changed
+}
+
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) > width {
+		runes = runes[:width]
+	}
+	return string(runes)
+}
+
+// expandTabs replaces tabs with spaces up to the next multiple of 8 columns, so the width of the line is known
+func expandTabs(line string) string {
+	if !strings.Contains(line, "\t") {
+		return line
+	}
+
+	var b strings.Builder
+	col := 0
+	for _, r := range line {
+		if r == '\t' {
+			spaces := 8 - col%8
+			b.WriteString(strings.Repeat(" ", spaces))
+			col += spaces
+			continue
+		}
+		b.WriteRune(r)
+		col++
+	}
+	return b.String()
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
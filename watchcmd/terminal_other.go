@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import "os"
+
+func terminalSize(f *os.File) (width, height int, ok bool) {
+	return 0, 0, false
+}
+
+func notifyResize(ch chan<- os.Signal) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// minDrift is the smallest drift of the run from its scheduled time shown in the header
+const minDrift = 10 * time.Millisecond
+
+// liveRedraw is the delay of redrawing the terminal when the command writes a line, the lines written meanwhile
+// are drawn at once
+const liveRedraw = 50 * time.Millisecond
+
+// finished is the result of the run started seq-th
+type finished struct {
+	seq int
+	res result
+}
+
+// streamed is a line written by the run started seq-th
+type streamed struct {
+	seq  int
+	line string
+}
+
+// watcher holds the state of the repeat loop: what is running, what was shown and the scheduling statistics
+type watcher struct {
+	cfg     config
+	scr     *screen
+	history *history
+	metrics *metrics
+	// log prefixes the messages with the job name if there is one
+	log *log.Logger
+
+	results chan finished
+	lines   chan streamed
+	redraw  <-chan time.Time
+	liveSeq int
+	seq     int
+	shown   int
+	running int
+	queued  int
+
+	runs     int
+	skipped  int
+	drift    time.Duration
+	maxDrift time.Duration
+
+	prev  []byte
+	first bool
+
+	// next is the time of the next regular run, it is zero if the command runs only when the files change
+	next time.Time
+	// attempt is the amount of retries since the last regular run, failures is the amount of consecutive failures
+	attempt     int
+	failures    int
+	retries     int
+	retry       <-chan time.Time
+	retryTimer  *time.Timer
+	retryAt     time.Time
+	pausedUntil time.Time
+	pauses      int
+}
+
+func newWatcher(cfg config, scr *screen, hist *history, m *metrics) *watcher {
+	logger := log.Default()
+	if cfg.name != "" {
+		logger = log.New(log.Writer(), cfg.name+": ", log.Flags()|log.Lmsgprefix)
+	}
+	return &watcher{cfg: cfg, scr: scr, history: hist, metrics: m, log: logger, results: make(chan finished), lines: make(chan streamed), first: true}
+}
+
+// start runs the command in a separate goroutine, the result is sent to w.results
+func (w *watcher) start(ctx context.Context) {
+	w.seq++
+	w.running++
+	w.runs++
+
+	var lines func(line []byte)
+	if w.cfg.stream {
+		w.scr.runSeparator(w.seq, time.Now())
+		lines = w.streamer(ctx, w.seq)
+	}
+	go func(seq int) {
+		w.results <- finished{seq: seq, res: runCmd(ctx, w.cfg, lines)}
+	}(w.seq)
+}
+
+// streamer returns the function passing the lines of the run to the screen. The appended output is written right
+// away by the goroutine of the run, the lines for the terminal are sent to the repeat loop, which owns the screen.
+func (w *watcher) streamer(ctx context.Context, seq int) func(line []byte) {
+	if !w.scr.tty {
+		return w.scr.streamLine
+	}
+	return func(line []byte) {
+		select {
+		case w.lines <- streamed{seq: seq, line: string(line)}:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// live shows the line of the running command on the terminal
+func (w *watcher) live(l streamed) {
+	// only the last started run is shown
+	if l.seq != w.seq {
+		return
+	}
+	if l.seq != w.liveSeq {
+		w.liveSeq = l.seq
+		w.scr.live = nil
+		w.scr.status = "running"
+	}
+	w.scr.liveLine(l.line)
+	if w.redraw == nil {
+		w.redraw = time.After(liveRedraw)
+	}
+}
+
+func (w *watcher) redrawLive() {
+	w.redraw = nil
+	w.scr.redraw()
+}
+
+// tick applies the overlap policy when the scheduled time comes, drift is how late the tick came
+func (w *watcher) tick(ctx context.Context, drift time.Duration) {
+	w.drift = drift
+	if drift > w.maxDrift {
+		w.maxDrift = drift
+	}
+
+	// the regular run replaces the retry
+	w.attempt = 0
+	w.stopRetry()
+	if w.paused() {
+		return
+	}
+
+	// like with the changes, a single run is queued, the ticks coming meanwhile are skipped
+	switch {
+	case w.running == 0 || w.cfg.overlap == "parallel":
+		w.start(ctx)
+	case w.cfg.overlap == "queue" && w.queued == 0:
+		w.queued++
+	default:
+		w.skip(1)
+	}
+}
+
+// change starts a run when the watched files change. A change during a run is never skipped: unless the runs
+// are parallel, one more run is queued after the current ones, so the last output reflects the last change.
+func (w *watcher) change(ctx context.Context) {
+	if !w.scr.tty {
+		w.log.Printf("files changed")
+	}
+
+	w.attempt = 0
+	w.stopRetry()
+	if w.paused() {
+		return
+	}
+
+	switch {
+	case w.running == 0 || w.cfg.overlap == "parallel":
+		w.start(ctx)
+	case w.queued == 0:
+		w.queued++
+	}
+}
+
+// scheduled shows the time of the next run if the runs are scheduled with -schedule
+func (w *watcher) scheduled(next time.Time) {
+	w.next = next
+	if w.cfg.schedule == "" {
+		return
+	}
+	if w.scr.tty {
+		w.scr.next = next
+		w.scr.redraw()
+		return
+	}
+	w.log.Printf("next run at %s", next.Format(time.RFC3339))
+}
+
+func (w *watcher) skip(n int) {
+	w.skipped += n
+	if !w.scr.tty {
+		w.log.Printf("skipped runs: %d, in total: %d", n, w.skipped)
+	}
+}
+
+// done handles the finished run and reports whether watching is done
+func (w *watcher) done(ctx context.Context, f finished) (bool, error) {
+	w.running--
+	if w.queued > 0 && w.running == 0 && ctx.Err() == nil {
+		w.queued--
+		w.start(ctx)
+	}
+
+	// the command was stopped because watchcmd is exiting
+	if ctx.Err() != nil {
+		return true, nil
+	}
+	// every finished run is recorded, even if it is not shown
+	w.metrics.record(f.res)
+	if err := w.history.add(f.res); err != nil {
+		w.log.Printf("%s", err)
+	}
+
+	// a parallel run started later has already been shown
+	if f.seq < w.shown {
+		return false, nil
+	}
+	w.shown = f.seq
+
+	res := f.res
+	if !w.cfg.stream {
+		w.scr.runSeparator(f.seq, res.start)
+	}
+	var (
+		retrying bool
+		next     string
+	)
+	if res.failed() {
+		retrying, next = w.failed()
+	} else {
+		w.succeeded()
+	}
+	w.scr.show(res.output, w.status(res))
+
+	changed := !w.first && !bytes.Equal(w.prev, res.output)
+	old := w.prev
+	w.prev, w.first = res.output, false
+
+	if changed && w.cfg.onChange != "" {
+		if err := runHook(ctx, w.cfg, old, res.output); err != nil {
+			w.log.Printf("on-change hook failed: %s", err)
+		}
+	}
+	if done, reason := w.cfg.until(res, changed); done {
+		w.scr.leave()
+		w.log.Printf("%s, exiting", reason)
+		return true, nil
+	}
+
+	if !res.failed() {
+		return false, nil
+	}
+	if w.cfg.beep {
+		w.scr.beep()
+	}
+	// -errexit exits only when there are no retries left
+	if w.cfg.errexit && !retrying {
+		return true, fmt.Errorf("command failed: %s", res.status())
+	}
+	// the status is already shown in the header on a terminal
+	if !w.scr.tty {
+		if next != "" {
+			next = ", " + next
+		}
+		w.log.Printf("command failed: %s%s", res.status(), next)
+	}
+	return false, nil
+}
+
+// status describes the run and the scheduling problems for the header
+func (w *watcher) status(res result) string {
+	parts := []string{res.status()}
+	// timers are usually late by a fraction of a millisecond, which is not worth showing
+	if drift := w.drift.Round(time.Millisecond); drift >= minDrift {
+		parts = append(parts, fmt.Sprintf("drift %s", drift))
+	}
+	if w.skipped > 0 {
+		parts = append(parts, fmt.Sprintf("skipped %d", w.skipped))
+	}
+	if w.queued > 0 {
+		parts = append(parts, fmt.Sprintf("queued %d", w.queued))
+	}
+	if w.running > 0 {
+		parts = append(parts, fmt.Sprintf("running %d", w.running))
+	}
+	if w.retry != nil {
+		parts = append(parts, fmt.Sprintf("retry %d/%d at %s", w.attempt+1, w.cfg.retries, w.retryAt.Format(time.TimeOnly)))
+	}
+	if !w.pausedUntil.IsZero() {
+		parts = append(parts, fmt.Sprintf("paused until %s", w.pausedUntil.Format(time.TimeOnly)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// wait waits for the runs still in progress, their results are dropped
+func (w *watcher) wait() {
+	for ; w.running > 0; w.running-- {
+		<-w.results
+	}
+}
+
+func (w *watcher) summary() string {
+	return fmt.Sprintf("runs: %d, retries: %d, skipped: %d, pauses: %d, max drift: %s",
+		w.runs, w.retries, w.skipped, w.pauses, w.maxDrift.Round(time.Millisecond))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing/fstest"
+	"text/tabwriter"
+	"time"
+)
+
+type benchConfig struct {
+	enabled  bool
+	runs     int
+	files    int
+	fileSize int
+}
+
+type benchResult struct {
+	mode           string
+	words          int
+	avg            time.Duration
+	min            time.Duration
+	allocs         uint64
+	allocBytes     uint64
+	peakGoroutines int
+}
+
+// corpusWords are used to generate synthetic corpus, non-ASCII words make sure that multibyte runes are counted too
+var corpusWords = []string{
+	"lorem", "ipsum", "dolor", "sit", "amet", "consectetur", "adipiscing", "elit",
+	"go", "goroutine", "channel", "select", "mutex", "42", "2023",
+	"привет", "мир", "слово", "файл", "日本語", "emoji😀", "naïve", "café",
+}
+
+var corpusSeparators = []string{" ", " ", " ", "\n", ", ", ". ", "\t", " - "}
+
+// benchCorpus returns generated in-memory corpus if cfg.files is set, otherwise the only source
+func benchCorpus(cfg benchConfig, sources []source) (fs.FS, error) {
+	if cfg.files > 0 {
+		return generateCorpus(cfg.files, cfg.fileSize), nil
+	}
+	if len(sources) != 1 {
+		return nil, fmt.Errorf("bench mode requires exactly one -path, got %d", len(sources))
+	}
+	return sources[0].fs, nil
+}
+
+// runBench runs every mode on the corpus cfg.runs times, newOptions creates settings for a single run
+func runBench(w io.Writer, corpus fs.FS, cfg benchConfig, newOptions func() *options) error {
+	files, size, err := corpusSize(corpus, newOptions().filter)
+	if err != nil {
+		return fmt.Errorf("calculate corpus size: %w", err)
+	}
+	fmt.Fprintf(w, "corpus: %d files, %.2f MB, %d runs per mode\n", files, float64(size)/1e6, cfg.runs)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "mode\twords\tavg\tmin\tMB/s\tfiles/s\tallocs/op\tB/op\tpeak goroutines")
+	var skipped []string
+	for _, mode := range allowedModes.All() {
+		res, err := benchMode(allowedModes[mode], corpus, cfg.runs, newOptions)
+		if errors.Is(err, errNoSourcePath) {
+			// keep all the cells, so the columns of the next rows stay aligned
+			fmt.Fprintf(tw, "%s\tskipped\t-\t-\t-\t-\t-\t-\t-\n", mode)
+			skipped = append(skipped, fmt.Sprintf("%s: %v", mode, err))
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("bench mode %q: %w", mode, err)
+		}
+		res.mode = mode
+
+		seconds := res.avg.Seconds()
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%.2f\t%.0f\t%d\t%d\t%d\n",
+			res.mode, res.words, res.avg.Round(time.Microsecond), res.min.Round(time.Microsecond),
+			float64(size)/1e6/seconds, float64(files)/seconds,
+			res.allocs, res.allocBytes, res.peakGoroutines)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, reason := range skipped {
+		fmt.Fprintf(w, "skipped %s\n", reason)
+	}
+	return nil
+}
+
+func benchMode(method CountMethod, f fs.FS, runs int, newOptions func() *options) (benchResult, error) {
+	var res benchResult
+	var total time.Duration
+	var before, after runtime.MemStats
+
+	stop := make(chan struct{})
+	peak := make(chan int)
+	go watchGoroutines(stop, peak)
+
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	for i := 0; i < runs; i++ {
+		start := time.Now()
+		files, err := method(f, newOptions())
+		elapsed := time.Since(start)
+		if err != nil {
+			close(stop)
+			<-peak
+			return res, err
+		}
+
+		res.words = totalCounts(files).Words
+		total += elapsed
+		if res.min == 0 || elapsed < res.min {
+			res.min = elapsed
+		}
+	}
+
+	runtime.ReadMemStats(&after)
+	close(stop)
+	res.peakGoroutines = <-peak
+
+	res.avg = total / time.Duration(runs)
+	res.allocs = (after.Mallocs - before.Mallocs) / uint64(runs)
+	res.allocBytes = (after.TotalAlloc - before.TotalAlloc) / uint64(runs)
+	return res, nil
+}
+
+// goroutineSampling is the period of watchGoroutines, it is long enough not to disturb the measured runs
+const goroutineSampling = 10 * time.Millisecond
+
+// watchGoroutines samples the number of goroutines until stop is closed and sends the observed maximum to peak.
+// The sampling goroutine itself is not counted. Short-lived goroutines may be missed, so the peak is approximate.
+func watchGoroutines(stop <-chan struct{}, peak chan<- int) {
+	ticker := time.NewTicker(goroutineSampling)
+	defer ticker.Stop()
+
+	max := 0
+	for {
+		select {
+		case <-stop:
+			peak <- max
+			return
+		case <-ticker.C:
+			if n := runtime.NumGoroutine() - 1; n > max {
+				max = n
+			}
+		}
+	}
+}
+
+// corpusSize calculates the amount and the total size of files which pass the filter,
+// binary files are sniffed the same way the counting does
+func corpusSize(f fs.FS, flt filter) (files int, size int64, err error) {
+	err = traverseThroughAllFiles(f, &options{filter: flt}, func(f fs.FS, path string) error {
+		if flt.skipBinary {
+			binary, err := isBinaryFile(f, path)
+			if err != nil {
+				return err
+			}
+			if binary {
+				return nil
+			}
+		}
+
+		info, err := fs.Stat(f, path)
+		if err != nil {
+			return err
+		}
+
+		files++
+		size += info.Size()
+		return nil
+	})
+	return files, size, err
+}
+
+// generateCorpus creates in-memory file tree with files of approximately fileSize bytes.
+// The content is deterministic, so the same arguments always produce the same corpus.
+func generateCorpus(files, fileSize int) fstest.MapFS {
+	rnd := rand.New(rand.NewSource(1))
+	corpus := make(fstest.MapFS, files)
+
+	for i := 0; i < files; i++ {
+		var sb strings.Builder
+		sb.Grow(fileSize)
+		for sb.Len() < fileSize {
+			sb.WriteString(corpusWords[rnd.Intn(len(corpusWords))])
+			sb.WriteString(corpusSeparators[rnd.Intn(len(corpusSeparators))])
+		}
+
+		path := fmt.Sprintf("dir%02d/file%04d.txt", i%16, i)
+		corpus[path] = &fstest.MapFile{Data: []byte(sb.String())}
+	}
+
+	return corpus
+}
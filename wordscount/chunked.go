@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"sync"
+	"time"
+)
+
+// chunkSize is the size of a byte range of a single file processed by one worker in chunked-parallel mode,
+// tests make it small to split files into many chunks
+var chunkSize int64 = 16 << 20
+
+type fileChunk struct {
+	file  *chunkedFile
+	index int
+	start int64
+	end   int64
+}
+
+type chunkResult struct {
+	counts Counts
+	// words are merged into the frequencies only when all chunks of the file are counted
+	words localFreq
+}
+
+type chunkedFile struct {
+	path    string
+	file    fs.File
+	reader  io.ReaderAt
+	size    int64
+	results []chunkResult
+	failed  bool
+	pending sync.WaitGroup
+	// duration is the wall time from opening the file until its last chunk is counted
+	start    time.Time
+	duration time.Duration
+}
+
+func calculateChunkedParallel(f fs.FS, opts *options) ([]FileCounts, error) {
+	// Split every file into byte ranges of chunkSize and count each range concurrently.
+	// Range bounds are moved to whitespace, so no word is split between two ranges whatever the tokenizer is.
+	goroutines := opts.workerCount()
+	var wg, closers sync.WaitGroup
+	var mu sync.Mutex
+	var files []*chunkedFile
+	ch := make(chan fileChunk)
+	wg.Add(goroutines)
+
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+
+			for c := range ch {
+				var words localFreq
+				if opts.freq != nil {
+					words = localFreq{}
+				}
+
+				res, err := countChunk(c.file.reader, c.start, c.end, c.file.size, opts.newTokenizer(sinkOrNil(words)))
+				res.words = words
+				if err != nil {
+					log.Printf("count words in %q [%d:%d]: %v", c.file.path, c.start, c.end, err)
+					mu.Lock()
+					c.file.failed = true
+					mu.Unlock()
+				} else {
+					opts.progress.counted(res.counts)
+				}
+				c.file.results[c.index] = res
+				c.file.pending.Done()
+			}
+		}()
+	}
+
+	var wholeFiles []FileCounts
+	walkerSink := opts.freq.sink()
+	defer opts.freq.release(walkerSink)
+
+	err := traverseThroughAllFiles(f, opts, func(f fs.FS, path string) error {
+		cf, err := openChunkedFile(f, path, opts.filter.skipBinary)
+		if err != nil {
+			opts.reject(path, err)
+			opts.progress.fileDone()
+			return nil
+		}
+
+		// fall back to reading the whole file if it does not support random access
+		if cf.reader == nil {
+			if file, ok := opts.countFile(f, path, walkerSink); ok {
+				wholeFiles = append(wholeFiles, file)
+			}
+			return nil
+		}
+
+		chunks := int((cf.size + chunkSize - 1) / chunkSize)
+		cf.results = make([]chunkResult, chunks)
+		cf.pending.Add(chunks)
+		files = append(files, cf)
+
+		// close the file once all of its chunks are counted, words of a failed file are dropped
+		closers.Add(1)
+		go func() {
+			defer closers.Done()
+			cf.pending.Wait()
+			cf.duration = time.Since(cf.start)
+			cf.file.Close()
+			if !cf.failed {
+				for _, res := range cf.results {
+					opts.freq.merge(res.words)
+				}
+			}
+			opts.progress.fileDone()
+		}()
+
+		for i := 0; i < chunks; i++ {
+			start := int64(i) * chunkSize
+			end := start + chunkSize
+			if end > cf.size {
+				end = cf.size
+			}
+			ch <- fileChunk{file: cf, index: i, start: start, end: end}
+		}
+		return nil
+	})
+
+	close(ch)
+	wg.Wait()
+	closers.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cf := range files {
+		if cf.failed {
+			continue
+		}
+		file := FileCounts{Path: cf.path, Duration: cf.duration}
+		for _, res := range cf.results {
+			file.Counts.Add(res.counts)
+		}
+		wholeFiles = append(wholeFiles, file)
+	}
+
+	return wholeFiles, nil
+}
+
+// openChunkedFile opens the file for random access. If skipBinary is set and the file content is binary skipError is returned.
+func openChunkedFile(f fs.FS, path string, skipBinary bool) (*chunkedFile, error) {
+	start := time.Now()
+	file, err := f.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("stat file: %w", err)
+	}
+
+	reader, ok := file.(io.ReaderAt)
+	if !ok {
+		file.Close()
+		return &chunkedFile{path: path}, nil
+	}
+
+	if skipBinary {
+		head := make([]byte, sniffLen)
+		n, err := reader.ReadAt(head, 0)
+		if err != nil && err != io.EOF {
+			file.Close()
+			return nil, fmt.Errorf("read file: %w", err)
+		}
+		if isBinary(head[:n]) {
+			file.Close()
+			return nil, skipError{reason: reasonBinary}
+		}
+	}
+
+	return &chunkedFile{path: path, file: file, reader: reader, size: info.Size(), start: start}, nil
+}
+
+// countChunk calculates Counts of the [start, end) range of r. Both bounds are moved forward right after
+// the nearest whitespace, so every rune and every word is counted by exactly one chunk.
+// Words are found by tok, which passes them to its sink.
+func countChunk(r io.ReaderAt, start, end, size int64, tok tokenizer) (chunkResult, error) {
+	from, err := alignToSpace(r, start, size)
+	if err != nil {
+		return chunkResult{}, fmt.Errorf("align chunk start: %w", err)
+	}
+	to, err := alignToSpace(r, end, size)
+	if err != nil {
+		return chunkResult{}, fmt.Errorf("align chunk end: %w", err)
+	}
+
+	if to <= from {
+		return chunkResult{}, nil
+	}
+
+	wc := wordCounter{tokens: tok}
+	if _, err := io.Copy(&wc, io.NewSectionReader(r, from, to-from)); err != nil {
+		return chunkResult{}, fmt.Errorf("read chunk: %w", err)
+	}
+	wc.flush()
+
+	return chunkResult{counts: wc.counts}, nil
+}
+
+// alignToSpace returns the offset right after the first ASCII whitespace at or after off, or size if there is none.
+// ASCII bytes never occur inside multibyte UTF-8 sequences, so the offset is always a rune start, and whitespace
+// separates words for every tokenizer.
+func alignToSpace(r io.ReaderAt, off, size int64) (int64, error) {
+	if off <= 0 || off >= size {
+		return off, nil
+	}
+
+	buf := make([]byte, 4<<10)
+	for off < size {
+		n, err := r.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+
+		for i, b := range buf[:n] {
+			switch b {
+			case ' ', '\t', '\n', '\v', '\f', '\r':
+				return off + int64(i) + 1, nil
+			}
+		}
+		off += int64(n)
+	}
+	return size, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"time"
+	"unicode/utf8"
+)
+
+// Counts holds the same statistics as `wc -lwmc` reports
+type Counts struct {
+	Lines int `json:"lines"`
+	Words int `json:"words"`
+	Runes int `json:"runes"`
+	Bytes int `json:"bytes"`
+}
+
+func (c *Counts) Add(other Counts) {
+	c.Lines += other.Lines
+	c.Words += other.Words
+	c.Runes += other.Runes
+	c.Bytes += other.Bytes
+}
+
+type FileCounts struct {
+	Path string `json:"path"`
+	Counts
+	Duration time.Duration `json:"duration_ns"`
+}
+
+func totalCounts(files []FileCounts) Counts {
+	var total Counts
+	for _, file := range files {
+		total.Add(file.Counts)
+	}
+	return total
+}
+
+// wordCounter calculates Counts of everything written into it in a single pass, words are found by the tokenizer.
+// A rune split between two writes is kept until the next write, so the data can be streamed in any portions.
+type wordCounter struct {
+	counts  Counts
+	tokens  tokenizer
+	carry   [utf8.UTFMax]byte
+	carried int
+}
+
+func (wc *wordCounter) Write(p []byte) (int, error) {
+	n := len(p)
+	wc.counts.Bytes += n
+
+	// complete the rune left from the previous write
+	for wc.carried > 0 && len(p) > 0 {
+		k := copy(wc.carry[wc.carried:], p)
+		buf := wc.carry[:wc.carried+k]
+		if !utf8.FullRune(buf) {
+			wc.carried += k
+			return n, nil
+		}
+
+		r, size := utf8.DecodeRune(buf)
+		wc.addRune(r)
+		if size >= wc.carried {
+			p = p[size-wc.carried:]
+			wc.carried = 0
+		} else {
+			copy(wc.carry[:], wc.carry[size:wc.carried])
+			wc.carried -= size
+		}
+	}
+
+	for len(p) > 0 {
+		if p[0] < utf8.RuneSelf {
+			wc.addRune(rune(p[0]))
+			p = p[1:]
+			continue
+		}
+
+		if !utf8.FullRune(p) {
+			wc.carried = copy(wc.carry[:], p)
+			break
+		}
+
+		r, size := utf8.DecodeRune(p)
+		wc.addRune(r)
+		p = p[size:]
+	}
+
+	return n, nil
+}
+
+// flush counts an incomplete rune and the word left at the end of the data
+func (wc *wordCounter) flush() {
+	buf := wc.carry[:wc.carried]
+	for len(buf) > 0 {
+		r, size := utf8.DecodeRune(buf)
+		wc.addRune(r)
+		buf = buf[size:]
+	}
+	wc.carried = 0
+
+	wc.counts.Words += wc.tokens.flush()
+}
+
+func (wc *wordCounter) addRune(r rune) {
+	wc.counts.Runes++
+	if r == '\n' {
+		wc.counts.Lines++
+	}
+	wc.counts.Words += wc.tokens.next(r)
+}
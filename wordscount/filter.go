@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// sniffLen is the amount of bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// reasons why a file or a directory is skipped
+const (
+	reasonHidden    = "hidden"
+	reasonDir       = "excluded directory"
+	reasonExtension = "extension"
+	reasonSize      = "size"
+	reasonBinary    = "binary"
+)
+
+type filter struct {
+	include    list
+	exclude    list
+	maxSize    int64
+	skipHidden bool
+	skipDirs   list
+	skipBinary bool
+}
+
+// list is a comma separated flag value
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(value string) error {
+	*l = nil
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+func (l list) contains(value string) bool {
+	for _, v := range l {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeExt makes extensions comparable with path.Ext results, so both "go" and ".GO" match "main.go"
+func normalizeExt(exts list) list {
+	normalized := make(list, 0, len(exts))
+	for _, ext := range exts {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		normalized = append(normalized, ext)
+	}
+	return normalized
+}
+
+func (flt filter) skipDir(p string, d fs.DirEntry) string {
+	// never skip the root
+	if p == "." {
+		return ""
+	}
+	if flt.skipHidden && isHidden(d.Name()) {
+		return reasonHidden
+	}
+	if flt.skipDirs.contains(d.Name()) {
+		return reasonDir
+	}
+	return ""
+}
+
+func (flt filter) skipFile(p string, d fs.DirEntry) (string, error) {
+	if flt.skipHidden && isHidden(d.Name()) {
+		return reasonHidden, nil
+	}
+
+	ext := strings.ToLower(path.Ext(p))
+	if len(flt.include) > 0 && !flt.include.contains(ext) {
+		return reasonExtension, nil
+	}
+	if flt.exclude.contains(ext) {
+		return reasonExtension, nil
+	}
+
+	if flt.maxSize > 0 {
+		info, err := d.Info()
+		if err != nil {
+			return "", fmt.Errorf("stat file: %w", err)
+		}
+		if info.Size() > flt.maxSize {
+			return reasonSize, nil
+		}
+	}
+
+	return "", nil
+}
+
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".") && name != "." && name != ".."
+}
+
+// isBinary detects binary content by the first sniffLen bytes of a file.
+// Everything http.DetectContentType does not recognize as text/* is treated as binary.
+func isBinary(head []byte) bool {
+	return !strings.HasPrefix(http.DetectContentType(head), "text/")
+}
+
+// isBinaryFile reads the first sniffLen bytes of the file and checks them with isBinary
+func isBinaryFile(f fs.FS, path string) (bool, error) {
+	file, err := f.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("open file: %w", err)
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, fmt.Errorf("read file: %w", err)
+	}
+	return isBinary(head[:n]), nil
+}
+
+// skipError is returned by countFile when the file content should not be counted
+type skipError struct {
+	reason string
+}
+
+func (e skipError) Error() string {
+	return fmt.Sprintf("skipped: %s", e.reason)
+}
+
+type SkippedFile struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// options holds settings shared by all CountMethods and collects files skipped during a single run
+type options struct {
+	root      string
+	workers   int
+	filter    filter
+	tokenizer string
+	progress  *progress
+	freq      *wordFreq
+
+	mu      sync.Mutex
+	skipped []SkippedFile
+}
+
+// workerCount returns the amount of workers for the modes with limited parallelism, runtime.NumCPU() by default
+func (o *options) workerCount() int {
+	if o.workers > 0 {
+		return o.workers
+	}
+	return runtime.NumCPU()
+}
+
+// newTokenizer creates the selected tokenizer for a single file or chunk, letters-and-digits by default
+func (o *options) newTokenizer(sink wordSink) tokenizer {
+	return allowedTokenizers[o.tokenizerName()](sink)
+}
+
+func (o *options) tokenizerName() string {
+	if o.tokenizer == "" {
+		return defaultTokenizer
+	}
+	return o.tokenizer
+}
+
+// forSource creates options for counting the source located at root with the same settings,
+// progress and word frequencies, but with its own list of skipped files
+func (o *options) forSource(root string) *options {
+	return &options{root: root, workers: o.workers, filter: o.filter, tokenizer: o.tokenizer, progress: o.progress, freq: o.freq}
+}
+
+// reject records the file as skipped if err is skipError and logs any other error
+func (o *options) reject(path string, err error) {
+	var skip skipError
+	if errors.As(err, &skip) {
+		o.skip(path, skip.reason)
+		return
+	}
+	log.Printf("count words in %q: %v", path, err)
+}
+
+func (o *options) skip(path, reason string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.skipped = append(o.skipped, SkippedFile{Path: path, Reason: reason})
+}
+
+func (o *options) skippedFiles() []SkippedFile {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	skipped := append([]SkippedFile(nil), o.skipped...)
+	sort.Slice(skipped, func(i, j int) bool {
+		return skipped[i].Path < skipped[j].Path
+	})
+	return skipped
+}
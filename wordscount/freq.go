@@ -0,0 +1,189 @@
+package main
+
+import (
+	"hash/maphash"
+	"sort"
+	"sync"
+)
+
+// shardsCount is the amount of independently locked parts of the sharded frequency map
+const shardsCount = 64
+
+var freqStrategies = list{"local", "sharded"}
+
+// Stat is a word with the amount of its usages, ordered the same way as in the files tool
+type Stat struct {
+	Word  string `json:"word"`
+	Count int    `json:"count"`
+}
+
+// wordSink receives every word found by wordCounter. The word is lowercased and must not be retained.
+type wordSink interface {
+	add(word []byte)
+}
+
+// freqSink is a wordSink of a worker, it also takes words counted separately, e.g. the words of a single file
+type freqSink interface {
+	wordSink
+	addCount(word string, n int)
+}
+
+// wordFreq counts word frequencies across all files using one of the strategies:
+//   - local: every worker collects words into its own map, maps are merged when the worker releases its sink
+//   - sharded: all workers write into the same map split into shards, each shard has its own mutex
+//
+// All methods are safe to call on a nil *wordFreq, in that case words are not collected at all.
+type wordFreq struct {
+	strategy string
+
+	mu     sync.Mutex
+	merged map[string]int
+
+	shards *shardedFreq
+}
+
+func newWordFreq(strategy string) *wordFreq {
+	wf := &wordFreq{strategy: strategy, merged: map[string]int{}}
+	if strategy == "sharded" {
+		wf.shards = newShardedFreq()
+	}
+	return wf
+}
+
+// sink returns wordSink for a single worker, it must be passed to release after the worker is done
+func (wf *wordFreq) sink() freqSink {
+	if wf == nil {
+		return nil
+	}
+	if wf.shards != nil {
+		return wf.shards
+	}
+	return localFreq{}
+}
+
+func (wf *wordFreq) release(s freqSink) {
+	local, ok := s.(localFreq)
+	if wf == nil || !ok {
+		return
+	}
+
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+	for word, count := range local {
+		wf.merged[word] += count
+	}
+}
+
+// merge adds word counts collected elsewhere, e.g. by a worker process
+func (wf *wordFreq) merge(counts map[string]int) {
+	if wf == nil || len(counts) == 0 {
+		return
+	}
+
+	if wf.shards != nil {
+		for word, count := range counts {
+			wf.shards.addCount(word, count)
+		}
+		return
+	}
+
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+	for word, count := range counts {
+		wf.merged[word] += count
+	}
+}
+
+// top returns n most frequent words, words with the same count are ordered lexicographically
+func (wf *wordFreq) top(n int) []Stat {
+	if wf == nil {
+		return nil
+	}
+
+	counts := wf.merged
+	if wf.shards != nil {
+		counts = wf.shards.collect()
+	}
+
+	stats := make([]Stat, 0, len(counts))
+	for word, count := range counts {
+		stats = append(stats, Stat{Word: word, Count: count})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count == stats[j].Count {
+			return stats[i].Word < stats[j].Word
+		}
+		return stats[i].Count > stats[j].Count
+	})
+
+	if n < len(stats) {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+type localFreq map[string]int
+
+func (lf localFreq) add(word []byte) {
+	lf[string(word)]++
+}
+
+func (lf localFreq) addCount(word string, n int) {
+	lf[word] += n
+}
+
+// mergeInto passes the collected words to sink, it does nothing if either of them is nil
+func (lf localFreq) mergeInto(sink freqSink) {
+	if sink == nil {
+		return
+	}
+	for word, count := range lf {
+		sink.addCount(word, count)
+	}
+}
+
+type shard struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+type shardedFreq struct {
+	seed   maphash.Seed
+	shards [shardsCount]shard
+}
+
+func newShardedFreq() *shardedFreq {
+	sf := &shardedFreq{seed: maphash.MakeSeed()}
+	for i := range sf.shards {
+		sf.shards[i].counts = map[string]int{}
+	}
+	return sf
+}
+
+func (sf *shardedFreq) add(word []byte) {
+	s := &sf.shards[maphash.Bytes(sf.seed, word)%shardsCount]
+	s.mu.Lock()
+	s.counts[string(word)]++
+	s.mu.Unlock()
+}
+
+func (sf *shardedFreq) addCount(word string, n int) {
+	s := &sf.shards[maphash.String(sf.seed, word)%shardsCount]
+	s.mu.Lock()
+	s.counts[word] += n
+	s.mu.Unlock()
+}
+
+func (sf *shardedFreq) collect() map[string]int {
+	counts := map[string]int{}
+	for i := range sf.shards {
+		s := &sf.shards[i]
+		s.mu.Lock()
+		for word, count := range s.counts {
+			counts[word] = count
+		}
+		s.mu.Unlock()
+	}
+	return counts
+}
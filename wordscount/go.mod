@@ -1,3 +1,8 @@
 module github.com/cloudmachinery/apps/wordscount
 
 go 1.20
+
+require (
+	github.com/rivo/uniseg v0.4.7
+	golang.org/x/sync v0.3.0
+)
@@ -10,13 +10,12 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"runtime/trace"
-	"strings"
+	"sort"
 	"sync"
-	"sync/atomic"
-	"unicode"
+	"time"
 )
 
-type CountMethod func(path string) (words int, err error)
+type CountMethod func(f fs.FS, opts *options) (files []FileCounts, err error)
 type Modes map[string]CountMethod
 
 func (m Modes) All() []string {
@@ -24,6 +23,7 @@ func (m Modes) All() []string {
 	for mode := range m {
 		modes = append(modes, mode)
 	}
+	sort.Strings(modes)
 	return modes
 }
 
@@ -36,24 +36,94 @@ var allowedModes = Modes{
 	"sequential":       calculateSequentially,
 	"parallel":         calculateParallel,
 	"limited-parallel": calculateLimitedParallel,
+	"chunked-parallel": calculateChunkedParallel,
+	"pipeline":         calculatePipeline,
+	"errgroup":         calculateErrgroup,
+	"multi-process":    calculateMultiProcess,
 }
 
 type config struct {
-	path       string
-	mode       string
-	cpuProfile string
-	trace      string
+	paths        paths
+	mode         string
+	cpuProfile   string
+	trace        string
+	workers      int
+	progress     bool
+	freq         int
+	freqStrategy string
+	tokenizer    string
+	filter       filter
+	report       reportConfig
+	bench        benchConfig
+	worker       bool
+	workerFreq   bool
 }
 
 func getConfig() (config, error) {
 	var cfg config
 
 	flag.StringVar(&cfg.mode, "mode", "sequential", fmt.Sprintf("Mode to run the program in %s", allowedModes.All()))
-	flag.StringVar(&cfg.path, "path", ".", "path to the directory to process")
+	flag.Var(&cfg.paths, "path", "path to the directory or .zip, .tar, .tar.gz archive to process, can be repeated (default .)")
 	flag.StringVar(&cfg.cpuProfile, "cpu-profile", "", "write cpu profile to file")
 	flag.StringVar(&cfg.trace, "trace", "", "write trace to file")
+	flag.IntVar(&cfg.workers, "workers", runtime.NumCPU(), "number of workers in the modes with limited parallelism")
+	flag.IntVar(&cfg.freq, "freq", 0, "report N most frequent words across all files, 0 disables word frequencies")
+	flag.StringVar(&cfg.freqStrategy, "freq-strategy", "local", fmt.Sprintf("how workers collect word frequencies %s", freqStrategies))
+	flag.StringVar(&cfg.tokenizer, "tokenizer", defaultTokenizer, fmt.Sprintf("how text is split into words %s", allowedTokenizers.All()))
+	flag.BoolVar(&cfg.progress, "progress", false, "show progress in stderr, ignored if stderr is not a terminal")
+	flag.Var(&cfg.filter.include, "include-ext", "comma separated file extensions to count, all files are counted if empty")
+	flag.Var(&cfg.filter.exclude, "exclude-ext", "comma separated file extensions to skip")
+	flag.Int64Var(&cfg.filter.maxSize, "max-size", 0, "skip files bigger than that many bytes, 0 means no limit")
+	flag.BoolVar(&cfg.filter.skipHidden, "skip-hidden", false, "skip hidden files and directories")
+	flag.Var(&cfg.filter.skipDirs, "skip-dirs", "comma separated directory names to skip, e.g. vendor,node_modules")
+	flag.BoolVar(&cfg.filter.skipBinary, "skip-binary", false, "skip files with binary content")
+	flag.BoolVar(&cfg.report.columns.lines, "l", false, "print the newline counts per file and in total")
+	flag.BoolVar(&cfg.report.columns.words, "w", false, "print the word counts per file and in total")
+	flag.BoolVar(&cfg.report.columns.runes, "m", false, "print the character (rune) counts per file and in total")
+	flag.BoolVar(&cfg.report.columns.bytes, "c", false, "print the byte counts per file and in total")
+	flag.StringVar(&cfg.report.format, "format", "text", fmt.Sprintf("output format %s", reportFormats))
+	flag.StringVar(&cfg.report.sortBy, "sort", "", fmt.Sprintf("sort files in report by %s, path if not set, implies the per file report", sortKeys.All()))
+	flag.IntVar(&cfg.report.top, "top", 0, "report only first N files after sorting, 0 means all files")
+	flag.BoolVar(&cfg.bench.enabled, "bench", false, "benchmark all modes instead of a single run")
+	flag.IntVar(&cfg.bench.runs, "bench-runs", 5, "number of runs of every mode in bench mode")
+	flag.IntVar(&cfg.bench.files, "bench-files", 0, "generate in-memory corpus with that many files instead of reading -path in bench mode")
+	flag.IntVar(&cfg.bench.fileSize, "bench-file-size", 64<<10, "size of a generated file in bytes in bench mode")
+	flag.BoolVar(&cfg.worker, "worker", false, "internal: run as a worker process of the multi-process mode")
+	flag.BoolVar(&cfg.workerFreq, "worker-freq", false, "internal: report words of every file in the worker process")
 	flag.Parse()
 
+	if len(cfg.paths) == 0 {
+		cfg.paths = paths{"."}
+	}
+
+	if cfg.workers < 1 {
+		return cfg, fmt.Errorf("invalid workers %d, must be positive", cfg.workers)
+	}
+
+	if cfg.freq < 0 {
+		return cfg, fmt.Errorf("invalid freq %d, must not be negative", cfg.freq)
+	}
+	if !freqStrategies.contains(cfg.freqStrategy) {
+		return cfg, fmt.Errorf("invalid freq strategy %q, allowed strategies: %s", cfg.freqStrategy, freqStrategies)
+	}
+	if !allowedTokenizers.IsAllowed(cfg.tokenizer) {
+		return cfg, fmt.Errorf("invalid tokenizer %q, allowed tokenizers: %s", cfg.tokenizer, allowedTokenizers.All())
+	}
+
+	cfg.filter.include = normalizeExt(cfg.filter.include)
+	cfg.filter.exclude = normalizeExt(cfg.filter.exclude)
+	if cfg.filter.maxSize < 0 {
+		return cfg, fmt.Errorf("invalid max size %d, must not be negative", cfg.filter.maxSize)
+	}
+
+	if err := cfg.report.validate(); err != nil {
+		return cfg, err
+	}
+
+	if cfg.bench.runs < 1 {
+		return cfg, fmt.Errorf("invalid bench runs %d, must be positive", cfg.bench.runs)
+	}
+
 	if !allowedModes.IsAllowed(cfg.mode) {
 		return cfg, fmt.Errorf("invalid mode %q, allowed modes: %s", cfg.mode, allowedModes.All())
 	}
@@ -67,7 +137,15 @@ func main() {
 		log.Fatal(err)
 	}
 
-	fmt.Printf("cores: %d, config: %+v\n", runtime.NumCPU(), cfg)
+	if cfg.worker {
+		if err := runWorkerProcess(cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// print to stderr, so json and csv reports in stdout stay parseable
+	fmt.Fprintf(os.Stderr, "cores: %d, config: %+v\n", runtime.NumCPU(), cfg)
 
 	if cfg.cpuProfile != "" {
 		f, err := os.Create(cfg.cpuProfile)
@@ -97,127 +175,286 @@ func main() {
 		}
 	}
 
+	sources, err := openSources(cfg.paths)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeSources(sources)
+
+	if cfg.bench.enabled {
+		corpus, err := benchCorpus(cfg.bench, sources)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// worker processes of the multi-process mode can only open the source by its path, not the generated corpus
+		var root string
+		if cfg.bench.files == 0 {
+			root = sources[0].root
+		}
+		newOptions := func() *options {
+			return &options{root: root, workers: cfg.workers, filter: cfg.filter, tokenizer: cfg.tokenizer}
+		}
+		if err := runBench(os.Stdout, corpus, cfg.bench, newOptions); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	method := allowedModes[cfg.mode]
 
-	var totalCount int
-	totalCount, err = method(cfg.path)
+	opts := &options{workers: cfg.workers, filter: cfg.filter, tokenizer: cfg.tokenizer, progress: newProgress(cfg.progress, len(sources))}
+	if cfg.freq > 0 {
+		opts.freq = newWordFreq(cfg.freqStrategy)
+	}
+	stopDump := dumpOnSignal(os.Stderr, opts.progress)
+	stopProgress := func() {}
+	if cfg.progress {
+		stopProgress = showProgress(opts.progress)
+	}
+
+	start := time.Now()
+	files, bySource, skipped, err := countSources(sources, method, opts)
+	elapsed := time.Since(start)
+	stopProgress()
+	stopDump()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fmt.Printf("Total words count: %d\n", totalCount)
+	r := newReport(files, skipped, opts.freq.top(cfg.freq), elapsed, cfg.report)
+	if len(sources) > 1 {
+		r.Sources = bySource
+	}
+	if err := printReport(os.Stdout, r, cfg.report); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runWorkerProcess(cfg config) error {
+	src, err := openSource(cfg.paths[0])
+	if err != nil {
+		return fmt.Errorf("open source %q: %w", cfg.paths[0], err)
+	}
+	defer closeSources([]source{src})
+
+	opts := &options{filter: cfg.filter, tokenizer: cfg.tokenizer}
+	return runWorker(os.Stdin, os.Stdout, src.fs, opts, cfg.workerFreq)
+}
+
+// countSources runs method on every source in turn. If there is more than one source,
+// paths of counted and skipped files are prefixed with the source name to tell them apart.
+func countSources(sources []source, method CountMethod, opts *options) ([]FileCounts, []SourceCounts, []SkippedFile, error) {
+	var files []FileCounts
+	var bySource []SourceCounts
+	var skipped []SkippedFile
+
+	for _, src := range sources {
+		srcOpts := opts.forSource(src.root)
+		srcFiles, err := method(src.fs, srcOpts)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("count words in %q: %w", src.name, err)
+		}
+		srcSkipped := srcOpts.skippedFiles()
+
+		if len(sources) > 1 {
+			for i := range srcFiles {
+				srcFiles[i].Path = src.name + "/" + srcFiles[i].Path
+			}
+			for i := range srcSkipped {
+				srcSkipped[i].Path = src.name + "/" + srcSkipped[i].Path
+			}
+		}
+
+		bySource = append(bySource, SourceCounts{Source: src.name, Files: len(srcFiles), Counts: totalCounts(srcFiles)})
+		files = append(files, srcFiles...)
+		skipped = append(skipped, srcSkipped...)
+	}
+
+	return files, bySource, skipped, nil
 }
 
-func calculateParallel(path string) (int, error) {
+func calculateParallel(f fs.FS, opts *options) ([]FileCounts, error) {
 	// Implement the same logic as in calculateSequential, but count words for each file in a separate goroutine
 	var wg sync.WaitGroup
-	var totalCount atomic.Int64
+	var mu sync.Mutex
+	var files []FileCounts
 
-	err := traverseThroughAllFiles(os.DirFS(path), func(f fs.FS, path string) error {
+	err := traverseThroughAllFiles(f, opts, func(f fs.FS, path string) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			count, err := countWords(f, path)
-			if err != nil {
-				log.Printf("count words in %q: %v", path, err)
+			sink := opts.freq.sink()
+			defer opts.freq.release(sink)
+
+			file, ok := opts.countFile(f, path, sink)
+			if !ok {
 				return
 			}
-			totalCount.Add(int64(count))
+
+			mu.Lock()
+			files = append(files, file)
+			mu.Unlock()
 		}()
 		return nil
 	})
 
 	wg.Wait()
-	return int(totalCount.Load()), err
+	return files, err
 }
 
-func calculateLimitedParallel(path string) (int, error) {
+func calculateLimitedParallel(f fs.FS, opts *options) ([]FileCounts, error) {
 	// Implement the same logic as in calculateParallel, but process each path in separate workers. Amount of workers should be equal to amount of CPU cores.
 	// Use channels
-	goroutines := runtime.NumCPU()
+	goroutines := opts.workerCount()
 	var wg sync.WaitGroup
-	var totalCount atomic.Int64
+	var mu sync.Mutex
+	var files []FileCounts
 	ch := make(chan string)
-	f := os.DirFS(path)
 	wg.Add(goroutines)
 
 	for i := 0; i < goroutines; i++ {
 		go func() {
 			defer wg.Done()
+			sink := opts.freq.sink()
+			defer opts.freq.release(sink)
+
 			for path := range ch {
-				count, err := countWords(f, path)
-				if err != nil {
-					log.Printf("count words in %q: %v", path, err)
+				file, ok := opts.countFile(f, path, sink)
+				if !ok {
 					continue
 				}
-				totalCount.Add(int64(count))
+
+				mu.Lock()
+				files = append(files, file)
+				mu.Unlock()
 			}
 		}()
 	}
 
-	err := traverseThroughAllFiles(os.DirFS(path), func(f fs.FS, path string) error {
+	err := traverseThroughAllFiles(f, opts, func(f fs.FS, path string) error {
 		ch <- path
 		return nil
 	})
 
 	close(ch)
+	wg.Wait()
 
 	if err != nil {
-    return 0, err
+		return nil, err
 	}
 
-	wg.Wait()
-
-	return int(totalCount.Load()), nil
+	return files, nil
 }
 
-func calculateSequentially(path string) (int, error) {
-	var totalCount int
+func calculateSequentially(f fs.FS, opts *options) ([]FileCounts, error) {
+	var files []FileCounts
+	sink := opts.freq.sink()
+	defer opts.freq.release(sink)
 
-	err := traverseThroughAllFiles(os.DirFS(path), func(f fs.FS, path string) error {
-		count, err := countWords(f, path)
-		if err != nil {
-			log.Printf("count words in %q: %v", path, err)
+	err := traverseThroughAllFiles(f, opts, func(f fs.FS, path string) error {
+		file, ok := opts.countFile(f, path, sink)
+		if !ok {
 			return nil
 		}
 
-		totalCount += count
+		files = append(files, file)
 		return nil
 	})
 
-	return totalCount, err
+	return files, err
 }
 
-func traverseThroughAllFiles(f fs.FS, fn func(f fs.FS, path string) error) error {
+// traverseThroughAllFiles calls fn for every file in f, which is not skipped by opts.filter
+func traverseThroughAllFiles(f fs.FS, opts *options, fn func(f fs.FS, path string) error) error {
+	defer opts.progress.walked()
+
 	return fs.WalkDir(f, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 
-		// skip directories
+		// skip directories, but do not descend into the filtered ones
 		if d.IsDir() {
+			if reason := opts.filter.skipDir(path, d); reason != "" {
+				opts.skip(path, reason)
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		reason, err := opts.filter.skipFile(path, d)
+		if err != nil {
+			log.Printf("filter %q: %v", path, err)
+			return nil
+		}
+		if reason != "" {
+			opts.skip(path, reason)
 			return nil
 		}
 
+		var size int64
+		if opts.progress.tracksSize() {
+			if info, err := d.Info(); err == nil {
+				size = info.Size()
+			}
+		}
+		opts.progress.discovered(size)
+
 		return fn(f, path)
 	})
 }
 
-func countWords(f fs.FS, path string) (int, error) {
+// countFile counts the file and reports whether it should be included in the results.
+// Skipped files are recorded in opts and errors are logged. Words are passed to sink if it is not nil,
+// they are collected per file first, so a file which fails halfway does not leave its words in the frequencies.
+func (o *options) countFile(f fs.FS, path string, sink freqSink) (FileCounts, bool) {
+	defer o.progress.fileDone()
+
+	var words localFreq
+	if sink != nil {
+		words = localFreq{}
+	}
+
+	file, err := countFile(f, path, o.filter.skipBinary, o.newTokenizer(sinkOrNil(words)))
+	if err != nil {
+		o.reject(path, err)
+		return file, false
+	}
+
+	words.mergeInto(sink)
+	o.progress.counted(file.Counts)
+	return file, true
+}
+
+// countFile streams the file through wordCounter, so the file is never loaded into memory as a whole.
+// If skipBinary is set the first sniffLen bytes are checked before counting and skipError is returned for a binary file.
+func countFile(f fs.FS, path string, skipBinary bool, tok tokenizer) (FileCounts, error) {
+	start := time.Now()
+
 	file, err := f.Open(path)
 	if err != nil {
-		return 0, fmt.Errorf("open file: %w", err)
+		return FileCounts{}, fmt.Errorf("open file: %w", err)
 	}
 	defer file.Close()
 
-	content, err := io.ReadAll(file)
-	if err != nil {
-		return 0, fmt.Errorf("read file: %w", err)
+	wc := wordCounter{tokens: tok}
+	if skipBinary {
+		head := make([]byte, sniffLen)
+		n, err := io.ReadFull(file, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return FileCounts{}, fmt.Errorf("read file: %w", err)
+		}
+		if isBinary(head[:n]) {
+			return FileCounts{}, skipError{reason: reasonBinary}
+		}
+		wc.Write(head[:n])
 	}
 
-	words := strings.FieldsFunc(string(content), func(r rune) bool {
-		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
-	})
+	if _, err := io.Copy(&wc, file); err != nil {
+		return FileCounts{}, fmt.Errorf("read file: %w", err)
+	}
+	wc.flush()
 
-	return len(words), nil
+	return FileCounts{Path: path, Counts: wc.counts, Duration: time.Since(start)}, nil
 }
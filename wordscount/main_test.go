@@ -0,0 +1,1107 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func Test_modesCountSameWords(t *testing.T) {
+	corpus := generateCorpus(64, 4<<10)
+	corpus["empty"] = &fstest.MapFile{}
+	corpus["dir/unicode"] = &fstest.MapFile{Data: []byte("привет, мир! 日本語 emoji😀 42")}
+
+	for _, name := range allowedTokenizers.All() {
+		files, err := calculateSequentially(corpus, &options{tokenizer: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := totalCounts(files)
+
+		for _, mode := range allowedModes.All() {
+			t.Run(mode+"/"+name, func(t *testing.T) {
+				files, err := allowedModes[mode](corpus, &options{tokenizer: name})
+				if errors.Is(err, errNoSourcePath) {
+					t.Skip("in-memory corpus can not be passed to worker processes")
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := totalCounts(files); got != want {
+					t.Errorf("%s() = %+v, want %+v", mode, got, want)
+				}
+			})
+		}
+	}
+}
+
+func Test_countsMatchWc(t *testing.T) {
+	// want is the output of `LC_ALL=C.UTF-8 wc -lwmc` for the same files
+	tests := []struct {
+		path string
+		data string
+		want Counts
+	}{
+		{"ascii.txt", "hello world\nfoo bar baz\n", Counts{Lines: 2, Words: 5, Runes: 24, Bytes: 24}},
+		{"no-newline.txt", "one two\nthree", Counts{Lines: 1, Words: 3, Runes: 13, Bytes: 13}},
+		{"multibyte.txt", "привет, мир!\n日本語 テキスト\temoji😀 42\n", Counts{Lines: 2, Words: 6, Runes: 32, Bytes: 58}},
+		{"crlf.txt", "a b\r\nc\r\n", Counts{Lines: 2, Words: 3, Runes: 8, Bytes: 8}},
+		{"blank.txt", "\n\n  \n", Counts{Lines: 3, Words: 0, Runes: 5, Bytes: 5}},
+		{"empty.txt", "", Counts{}},
+	}
+
+	corpus := fstest.MapFS{}
+	want := map[string]Counts{}
+	for _, tt := range tests {
+		corpus[tt.path] = &fstest.MapFile{Data: []byte(tt.data)}
+		want[tt.path] = tt.want
+	}
+
+	// chunks of a few bytes split the multi-byte runes and the words
+	defer func(size int64) { chunkSize = size }(chunkSize)
+	chunkSize = 5
+
+	for _, mode := range allowedModes.All() {
+		t.Run(mode, func(t *testing.T) {
+			files, err := allowedModes[mode](corpus, &options{tokenizer: "whitespace"})
+			if errors.Is(err, errNoSourcePath) {
+				t.Skip("in-memory corpus can not be passed to worker processes")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string]Counts{}
+			for _, file := range files {
+				got[file.Path] = file.Counts
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("counts = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func Test_tokenizers(t *testing.T) {
+	tests := []struct {
+		tokenizer string
+		text      string
+		want      []string
+	}{
+		{"whitespace", "Hello, world!\t foo-bar  42\n", []string{"hello,", "world!", "foo-bar", "42"}},
+		{"letters-and-digits", "Hello, world! foo-bar snake_case 42", []string{"hello", "world", "foo", "bar", "snake", "case", "42"}},
+		{"identifier", "parseHTTPServer2Config snake_case MD5Sum XMLHttp x", []string{"parse", "http", "server2", "config", "snake", "case", "md5", "sum", "xml", "http", "x"}},
+		{"identifier", "ПриветМир", []string{"привет", "мир"}},
+		{"uax29", "Don't stop: 3.14, 1,000 e.g. end.", []string{"don't", "stop", "3.14", "1,000", "e.g", "end"}},
+		{"uax29", "snake_case foo.bar 日本語 カタカナ 😀👍🏽", []string{"snake_case", "foo.bar", "日", "本", "語", "カタカナ"}},
+		{"uax29", "a'\u0301b x\u00ADy привет, мир", []string{"a'\u0301b", "x\u00ady", "привет", "мир"}},
+		{"uax29", "ﾃｽﾄｰ a\u203fb ٣٫١٤ 1٬000 צה\"ל «quoted»", []string{"ﾃｽﾄｰ", "a\u203fb", "٣٫١٤", "1٬000", "צה\"ל", "quoted"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tokenizer+"/"+tt.text, func(t *testing.T) {
+			sink := &wordList{}
+			wc := wordCounter{tokens: allowedTokenizers[tt.tokenizer](sink)}
+			wc.Write([]byte(tt.text))
+			wc.flush()
+
+			if !reflect.DeepEqual(sink.words, tt.want) {
+				t.Errorf("words = %q, want %q", sink.words, tt.want)
+			}
+			if wc.counts.Words != len(tt.want) {
+				t.Errorf("count = %d, want %d", wc.counts.Words, len(tt.want))
+			}
+		})
+	}
+}
+
+// Test_uax29LongRun checks that a run without whitespace longer than uax29MaxRun is segmented in parts correctly
+func Test_uax29LongRun(t *testing.T) {
+	text := strings.Repeat("foo.bar,3.14;", uax29MaxRun/4)
+	sink := localFreq{}
+	wc := wordCounter{tokens: allowedTokenizers["uax29"](sink)}
+	for rest := []byte(text); len(rest) > 0; {
+		n := 1000
+		if n > len(rest) {
+			n = len(rest)
+		}
+		wc.Write(rest[:n])
+		rest = rest[n:]
+	}
+	wc.flush()
+
+	want := localFreq{"foo.bar": uax29MaxRun / 4, "3.14": uax29MaxRun / 4}
+	if !reflect.DeepEqual(sink, want) {
+		t.Errorf("words = %v, want %v", sink, want)
+	}
+}
+
+// Test_chunksCountSameWords splits the text into chunks at every offset and checks that no word is lost or counted twice
+func Test_chunksCountSameWords(t *testing.T) {
+	text := []byte("fooBar  HTTPServer, 3.14\nDon't привет_мир 日本語 😀 end.")
+	size := int64(len(text))
+
+	for _, name := range allowedTokenizers.All() {
+		wc := wordCounter{tokens: allowedTokenizers[name](nil)}
+		wc.Write(text)
+		wc.flush()
+
+		for split := int64(1); split < size; split++ {
+			var got Counts
+			for _, bounds := range [][2]int64{{0, split}, {split, size}} {
+				res, err := countChunk(bytes.NewReader(text), bounds[0], bounds[1], size, allowedTokenizers[name](nil))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got.Add(res.counts)
+			}
+			if got != wc.counts {
+				t.Errorf("%s: split at %d = %+v, want %+v", name, split, got, wc.counts)
+			}
+		}
+	}
+}
+
+// Test_chunkedParallelSplitsFiles counts files split into many small chunks, so words straddle chunk bounds
+func Test_chunkedParallelSplitsFiles(t *testing.T) {
+	defer func(size int64) { chunkSize = size }(chunkSize)
+	chunkSize = 61
+
+	corpus := generateCorpus(8, 4<<10)
+	corpus["dir/unicode"] = &fstest.MapFile{Data: bytes.Repeat([]byte("привет,  мир!\t日本語 emoji😀\n42 "), 20)}
+	corpus["dir/no-spaces"] = &fstest.MapFile{Data: bytes.Repeat([]byte("word"), 100)}
+
+	files, err := calculateSequentially(corpus, &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Counts{}
+	for _, file := range files {
+		want[file.Path] = file.Counts
+	}
+
+	files, err = calculateChunkedParallel(corpus, &options{workers: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(want) {
+		t.Fatalf("counted %d files, want %d", len(files), len(want))
+	}
+	for _, file := range files {
+		if file.Counts != want[file.Path] {
+			t.Errorf("%s: counts = %+v, want %+v", file.Path, file.Counts, want[file.Path])
+		}
+	}
+}
+
+type wordList struct {
+	words []string
+}
+
+func (l *wordList) add(word []byte) {
+	l.words = append(l.words, string(word))
+}
+
+func Test_modesCountSameFrequencies(t *testing.T) {
+	corpus := generateCorpus(64, 4<<10)
+
+	opts := &options{freq: newWordFreq("local")}
+	if _, err := calculateSequentially(corpus, opts); err != nil {
+		t.Fatal(err)
+	}
+	want := opts.freq.top(10)
+
+	for _, mode := range allowedModes.All() {
+		for _, strategy := range freqStrategies {
+			t.Run(mode+"/"+strategy, func(t *testing.T) {
+				opts := &options{freq: newWordFreq(strategy)}
+				_, err := allowedModes[mode](corpus, opts)
+				if errors.Is(err, errNoSourcePath) {
+					t.Skip("in-memory corpus can not be passed to worker processes")
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := opts.freq.top(10); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s() top words = %v, want %v", mode, got, want)
+				}
+			})
+		}
+	}
+}
+
+// Test_failedFileWordsAreNotCounted checks that the words read before a file fails do not get into the frequencies
+func Test_failedFileWordsAreNotCounted(t *testing.T) {
+	corpus := generateCorpus(8, 4<<10)
+	opts := &options{freq: newWordFreq("local")}
+	if _, err := calculateSequentially(corpus, opts); err != nil {
+		t.Fatal(err)
+	}
+	want := opts.freq.top(100)
+
+	broken := failingFS{MapFS: corpus, path: "broken.txt", data: bytes.Repeat([]byte("zzz "), 1000)}
+	corpus[broken.path] = &fstest.MapFile{}
+
+	for _, mode := range allowedModes.All() {
+		for _, strategy := range freqStrategies {
+			t.Run(mode+"/"+strategy, func(t *testing.T) {
+				opts := &options{freq: newWordFreq(strategy)}
+				_, err := allowedModes[mode](broken, opts)
+				if errors.Is(err, errNoSourcePath) {
+					t.Skip("in-memory corpus can not be passed to worker processes")
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := opts.freq.top(100); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s() top words = %v, want %v", mode, got, want)
+				}
+			})
+		}
+	}
+}
+
+// failingFS returns a file at path which fails after data is read
+type failingFS struct {
+	fstest.MapFS
+	path string
+	data []byte
+}
+
+func (f failingFS) Open(name string) (fs.File, error) {
+	file, err := f.MapFS.Open(name)
+	if err != nil || name != f.path {
+		return file, err
+	}
+	return &failingFile{File: file, data: f.data}, nil
+}
+
+type failingFile struct {
+	fs.File
+	data []byte
+}
+
+func (f *failingFile) Read(b []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, errors.New("read failed")
+	}
+	n := copy(b, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func Test_runWorker(t *testing.T) {
+	corpus := fstest.MapFS{
+		"a.txt": {Data: []byte("Hello, hello world")},
+		"image": {Data: []byte{0x89, 'P', 'N', 'G', 0, 0, 0, 0}},
+	}
+	tests := []struct {
+		path string
+		want workerResponse
+	}{
+		{"a.txt", workerResponse{FileCounts: FileCounts{Path: "a.txt", Counts: Counts{Words: 3, Runes: 18, Bytes: 18}}, Freq: map[string]int{"hello": 2, "world": 1}}},
+		{"image", workerResponse{FileCounts: FileCounts{Path: "image"}, Skipped: reasonBinary}},
+		{"missing.txt", workerResponse{FileCounts: FileCounts{Path: "missing.txt"}, Error: "open file: open missing.txt: file does not exist"}},
+	}
+
+	stdin, requests := io.Pipe()
+	responses, stdout := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- runWorker(stdin, stdout, corpus, &options{filter: filter{skipBinary: true}}, true)
+		stdout.Close()
+	}()
+
+	enc := json.NewEncoder(requests)
+	lines := bufio.NewScanner(responses)
+	for _, tt := range tests {
+		if err := enc.Encode(workerRequest{Path: tt.path}); err != nil {
+			t.Fatal(err)
+		}
+		if !lines.Scan() {
+			t.Fatalf("no response for %s: %v", tt.path, lines.Err())
+		}
+
+		var got workerResponse
+		if err := json.Unmarshal(lines.Bytes(), &got); err != nil {
+			t.Fatalf("response %q is not a JSON line: %v", lines.Text(), err)
+		}
+		got.Duration = 0
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("response for %s = %+v, want %+v", tt.path, got, tt.want)
+		}
+	}
+
+	requests.Close()
+	if err := <-done; err != nil {
+		t.Errorf("runWorker() = %v", err)
+	}
+}
+
+// helperWorkerEnv is set to the directory the helper worker process reads files from
+const helperWorkerEnv = "WORDSCOUNT_HELPER_WORKER"
+
+// Test_helperWorker is not a real test, it is started as a worker process by the supervisor tests.
+// It counts files like the real worker, but crashes on crash.txt, crashes once on crash-once.txt, hangs on hang.txt
+// and writes a line which is not a response on garbage.txt.
+func Test_helperWorker(t *testing.T) {
+	dir := os.Getenv(helperWorkerEnv)
+	if dir == "" {
+		t.Skip("started by the supervisor tests only")
+	}
+
+	if err := runWorker(os.Stdin, os.Stdout, helperFS{dir}, &options{}, false); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+type helperFS struct {
+	dir string
+}
+
+func (h helperFS) Open(name string) (fs.File, error) {
+	switch name {
+	case "crash.txt":
+		os.Exit(3)
+	case "crash-once.txt":
+		marker := filepath.Join(h.dir, "crashed")
+		if _, err := os.Stat(marker); err != nil {
+			os.WriteFile(marker, nil, 0o644)
+			os.Exit(3)
+		}
+	case "hang.txt":
+		time.Sleep(time.Hour)
+	case "garbage.txt":
+		fmt.Println("not a response")
+	}
+	return os.DirFS(h.dir).Open(name)
+}
+
+func Test_runSupervisors(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.txt":          "one two",
+		"b.txt":          "three",
+		"crash.txt":      "never counted",
+		"crash-once.txt": "four five six",
+		"hang.txt":       "never counted",
+		"z.txt":          "seven eight nine ten",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv(helperWorkerEnv, dir)
+	args := []string{os.Args[0], "-test.run=^Test_helperWorker$"}
+
+	// the files are walked from another copy of the directory, so the marker of crash-once.txt is not counted
+	walked := fstest.MapFS{}
+	for name, data := range files {
+		walked[name] = &fstest.MapFile{Data: []byte(data)}
+	}
+
+	counted, err := runSupervisors(walked, &options{workers: 2}, args, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]int{}
+	for _, file := range counted {
+		got[file.Path] = file.Words
+	}
+	want := map[string]int{"a.txt": 2, "b.txt": 1, "crash-once.txt": 3, "z.txt": 4}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("counted words = %v, want %v", got, want)
+	}
+}
+
+func Test_runSupervisorsGarbage(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.txt":       "one two",
+		"garbage.txt": "never counted",
+	}
+	want := map[string]int{"a.txt": 2}
+	// more paths than workerInflight follow the garbage, so the walk is not finished and the worker stdin is kept open
+	for i := 0; i < 2*workerInflight; i++ {
+		name := fmt.Sprintf("z%02d.txt", i)
+		files[name] = "three four five"
+		want[name] = 3
+	}
+	walked := fstest.MapFS{}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		walked[name] = &fstest.MapFile{Data: []byte(data)}
+	}
+	t.Setenv(helperWorkerEnv, dir)
+	args := []string{os.Args[0], "-test.run=^Test_helperWorker$"}
+
+	// the worker is alive and keeps its stdout open, so the supervisor must not wait for it after the garbage line,
+	// the timeout is long to tell that from the watchdog killing the worker
+	type result struct {
+		counted []FileCounts
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		counted, err := runSupervisors(walked, &options{workers: 1}, args, time.Minute)
+		done <- result{counted, err}
+	}()
+
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("runSupervisors() is blocked after a malformed response")
+	}
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	got := map[string]int{}
+	for _, file := range res.counted {
+		got[file.Path] = file.Words
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("counted words = %v, want %v", got, want)
+	}
+}
+
+func Test_runSupervisorsFailed(t *testing.T) {
+	corpus := generateCorpus(64, 16)
+	args := []string{filepath.Join(t.TempDir(), "missing-binary")}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := runSupervisors(corpus, &options{workers: 2}, args, time.Second)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("runSupervisors() error = nil, want error of starting workers")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runSupervisors() is blocked after all the workers failed to start")
+	}
+}
+
+func Benchmark_modes(b *testing.B) {
+	corpus := generateCorpus(256, 64<<10)
+	_, size, err := corpusSize(corpus, filter{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, mode := range allowedModes.All() {
+		method := allowedModes[mode]
+		b.Run(mode, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				_, err := method(corpus, &options{})
+				if errors.Is(err, errNoSourcePath) {
+					b.Skip("in-memory corpus can not be passed to worker processes")
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func testReportFiles() []FileCounts {
+	return []FileCounts{
+		{Path: "b.txt", Counts: Counts{Lines: 1, Words: 2, Runes: 10, Bytes: 12}, Duration: 3 * time.Millisecond},
+		{Path: "a.txt", Counts: Counts{Lines: 5, Words: 20, Runes: 100, Bytes: 100}, Duration: time.Millisecond},
+		{Path: `dir/c, "q".txt`, Counts: Counts{Lines: 2, Words: 2, Runes: 8, Bytes: 8}, Duration: 2 * time.Millisecond},
+	}
+}
+
+func Test_newReport(t *testing.T) {
+	tests := []struct {
+		sortBy string
+		top    int
+		want   []string
+	}{
+		{"", 0, []string{"a.txt", "b.txt", `dir/c, "q".txt`}},
+		{"path", 2, []string{"a.txt", "b.txt"}},
+		// equal counts are ordered by path
+		{"words", 0, []string{"a.txt", "b.txt", `dir/c, "q".txt`}},
+		{"duration", 0, []string{"b.txt", `dir/c, "q".txt`, "a.txt"}},
+		{"bytes", 1, []string{"a.txt"}},
+		{"lines", 10, []string{"a.txt", `dir/c, "q".txt`, "b.txt"}},
+	}
+
+	for _, tt := range tests {
+		r := newReport(testReportFiles(), nil, nil, time.Second, reportConfig{sortBy: tt.sortBy, top: tt.top})
+		var got []string
+		for _, file := range r.Files {
+			got = append(got, file.Path)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sort %q top %d: files %q, want %q", tt.sortBy, tt.top, got, tt.want)
+		}
+		if want := (Counts{Lines: 8, Words: 24, Runes: 118, Bytes: 120}); r.Total != want {
+			t.Errorf("sort %q top %d: total %+v, want %+v", tt.sortBy, tt.top, r.Total, want)
+		}
+	}
+}
+
+func Test_printReport(t *testing.T) {
+	skipped := []SkippedFile{{"x.bin", reasonBinary}, {".git", reasonHidden}, {"y.bin", reasonBinary}}
+	topWords := []Stat{{"the", 7}, {"a", 3}}
+	sources := []SourceCounts{{Source: "src", Files: 2, Counts: Counts{Lines: 6, Words: 22, Runes: 110, Bytes: 112}}}
+
+	tests := []struct {
+		name     string
+		cfg      reportConfig
+		skipped  []SkippedFile
+		topWords []Stat
+		sources  []SourceCounts
+		want     string
+	}{
+		{
+			name:     "text total",
+			cfg:      reportConfig{format: "text"},
+			skipped:  skipped,
+			topWords: topWords,
+			want: "Total words count: 24\n" +
+				"Skipped: 3 (binary: 2, hidden: 1)\n" +
+				"Top words:\nthe: 7\na: 3\n",
+		},
+		{
+			name: "text sorted",
+			cfg:  reportConfig{format: "text", sortBy: "words", top: 2},
+			want: " 20 100  1ms a.txt\n" +
+				"  2  12  3ms b.txt\n" +
+				" 24 120 10ms total\n",
+		},
+		{
+			name:    "text columns",
+			cfg:     reportConfig{format: "text", columns: columns{lines: true, runes: true}},
+			sources: sources,
+			skipped: skipped[:1],
+			want: " 5 100  1ms a.txt\n" +
+				" 1  10  3ms b.txt\n" +
+				" 2   8  2ms dir/c, \"q\".txt\n" +
+				" 8 118 10ms total\n" +
+				"Totals by source:\n" +
+				" 2 files 6 110 src\n" +
+				"Skipped: 1 (binary: 1)\n",
+		},
+		{
+			name: "json",
+			cfg:  reportConfig{format: "json", top: 1},
+			want: `{
+  "files": [
+    {
+      "path": "a.txt",
+      "lines": 5,
+      "words": 20,
+      "runes": 100,
+      "bytes": 100,
+      "duration_ns": 1000000
+    }
+  ],
+  "total": {
+    "lines": 8,
+    "words": 24,
+    "runes": 118,
+    "bytes": 120
+  },
+  "duration_ns": 10000000,
+  "skipped": []
+}
+`,
+		},
+		{
+			name:     "json words",
+			cfg:      reportConfig{format: "json", top: 1, sortBy: "runes"},
+			skipped:  skipped[1:2],
+			topWords: topWords[:1],
+			want: `{
+  "files": [
+    {
+      "path": "a.txt",
+      "lines": 5,
+      "words": 20,
+      "runes": 100,
+      "bytes": 100,
+      "duration_ns": 1000000
+    }
+  ],
+  "total": {
+    "lines": 8,
+    "words": 24,
+    "runes": 118,
+    "bytes": 120
+  },
+  "duration_ns": 10000000,
+  "skipped": [
+    {
+      "path": ".git",
+      "reason": "hidden"
+    }
+  ],
+  "top_words": [
+    {
+      "word": "the",
+      "count": 7
+    }
+  ]
+}
+`,
+		},
+		{
+			name:     "csv",
+			cfg:      reportConfig{format: "csv", sortBy: "bytes"},
+			skipped:  skipped,
+			topWords: topWords,
+			want: "path,lines,words,runes,bytes,duration_ns\n" +
+				"a.txt,5,20,100,100,1000000\n" +
+				"b.txt,1,2,10,12,3000000\n" +
+				`"dir/c, ""q"".txt",2,2,8,8,2000000` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReport(testReportFiles(), tt.skipped, tt.topWords, 10*time.Millisecond, tt.cfg)
+			r.Sources = tt.sources
+
+			var got strings.Builder
+			if err := printReport(&got, r, tt.cfg); err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("report =\n%s\nwant\n%s", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_normalizeExt(t *testing.T) {
+	got := normalizeExt(list{"go", ".go", "GO", ".Md", "tar.gz"})
+	want := list{".go", ".go", ".go", ".md", ".tar.gz"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("normalizeExt() = %q, want %q", got, want)
+	}
+}
+
+func Test_isBinary(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want bool
+	}{
+		{"empty", nil, false},
+		{"ascii", []byte("hello world\n"), false},
+		{"utf-8", []byte("привет, мир! 日本語\n"), false},
+		{"png", append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 16)...), true},
+		{"zero bytes", []byte("text\x00\x00\x01\x02"), true},
+		{"gzip", []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00"), true},
+	}
+
+	for _, tt := range tests {
+		if got := isBinary(tt.head); got != tt.want {
+			t.Errorf("isBinary(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_filter(t *testing.T) {
+	corpus := fstest.MapFS{
+		"main.go":          {Data: []byte("package main\n")},
+		"README.MD":        {Data: []byte("# title\n")},
+		"notes.txt":        {Data: []byte("some notes\n")},
+		"big.txt":          {Data: bytes.Repeat([]byte("word "), 400)},
+		".env":             {Data: []byte("SECRET=1\n")},
+		".git/config":      {Data: []byte("[core]\n")},
+		"vendor/lib.go":    {Data: []byte("package lib\n")},
+		"dir/.hidden/a.go": {Data: []byte("package a\n")},
+		"image.png":        {Data: append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 64)...)},
+	}
+	all := []string{".env", ".git/config", "README.MD", "big.txt", "dir/.hidden/a.go", "image.png", "main.go", "notes.txt", "vendor/lib.go"}
+
+	tests := []struct {
+		name        string
+		filter      filter
+		wantCounted []string
+		wantSkipped []SkippedFile
+	}{
+		{"no filters", filter{}, all, nil},
+		{
+			name:        "hidden",
+			filter:      filter{skipHidden: true},
+			wantCounted: []string{"README.MD", "big.txt", "image.png", "main.go", "notes.txt", "vendor/lib.go"},
+			wantSkipped: []SkippedFile{{".env", reasonHidden}, {".git", reasonHidden}, {"dir/.hidden", reasonHidden}},
+		},
+		{
+			name:        "excluded directories",
+			filter:      filter{skipDirs: list{"vendor", ".git"}},
+			wantCounted: []string{".env", "README.MD", "big.txt", "dir/.hidden/a.go", "image.png", "main.go", "notes.txt"},
+			wantSkipped: []SkippedFile{{".git", reasonDir}, {"vendor", reasonDir}},
+		},
+		{
+			name:        "include",
+			filter:      filter{include: normalizeExt(list{"GO", ".md"})},
+			wantCounted: []string{"README.MD", "dir/.hidden/a.go", "main.go", "vendor/lib.go"},
+			wantSkipped: []SkippedFile{{".env", reasonExtension}, {".git/config", reasonExtension}, {"big.txt", reasonExtension},
+				{"image.png", reasonExtension}, {"notes.txt", reasonExtension}},
+		},
+		{
+			name:        "exclude",
+			filter:      filter{exclude: normalizeExt(list{"txt", "png"})},
+			wantCounted: []string{".env", ".git/config", "README.MD", "dir/.hidden/a.go", "main.go", "vendor/lib.go"},
+			wantSkipped: []SkippedFile{{"big.txt", reasonExtension}, {"image.png", reasonExtension}, {"notes.txt", reasonExtension}},
+		},
+		{
+			name:        "size",
+			filter:      filter{maxSize: 1000},
+			wantCounted: []string{".env", ".git/config", "README.MD", "dir/.hidden/a.go", "image.png", "main.go", "notes.txt", "vendor/lib.go"},
+			wantSkipped: []SkippedFile{{"big.txt", reasonSize}},
+		},
+		{
+			name:        "binary",
+			filter:      filter{skipBinary: true},
+			wantCounted: []string{".env", ".git/config", "README.MD", "big.txt", "dir/.hidden/a.go", "main.go", "notes.txt", "vendor/lib.go"},
+			wantSkipped: []SkippedFile{{"image.png", reasonBinary}},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, mode := range []string{"sequential", "chunked-parallel", "pipeline"} {
+			t.Run(tt.name+"/"+mode, func(t *testing.T) {
+				opts := &options{filter: tt.filter}
+				files, err := allowedModes[mode](corpus, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var counted []string
+				for _, file := range files {
+					counted = append(counted, file.Path)
+				}
+				sort.Strings(counted)
+				if !reflect.DeepEqual(counted, tt.wantCounted) {
+					t.Errorf("counted %q, want %q", counted, tt.wantCounted)
+				}
+				if skipped := opts.skippedFiles(); !reflect.DeepEqual(skipped, tt.wantSkipped) {
+					t.Errorf("skipped %v, want %v", skipped, tt.wantSkipped)
+				}
+			})
+		}
+	}
+}
+
+func Test_printSkipped(t *testing.T) {
+	tests := []struct {
+		skipped []SkippedFile
+		want    string
+	}{
+		{nil, ""},
+		{[]SkippedFile{{"a.png", reasonBinary}}, "Skipped: 1 (binary: 1)\n"},
+		{
+			[]SkippedFile{{"a.png", reasonBinary}, {".git", reasonHidden}, {"vendor", reasonDir}, {"b.png", reasonBinary}, {"big.log", reasonSize}},
+			"Skipped: 5 (binary: 2, excluded directory: 1, hidden: 1, size: 1)\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var got strings.Builder
+		if err := printSkipped(&got, tt.skipped); err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != tt.want {
+			t.Errorf("printSkipped(%v) = %q, want %q", tt.skipped, got.String(), tt.want)
+		}
+	}
+}
+
+// chanWriter passes every write to the channel, so a test can wait for the output of another goroutine
+type chanWriter chan string
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- string(b)
+	return len(b), nil
+}
+
+// testProgress returns progress with a fake clock, the clock is moved by the returned function
+func testProgress(withSize bool) (*progress, func(d time.Duration)) {
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	now := start
+	p := newProgress(withSize, 1)
+	p.start = start
+	p.now = func() time.Time { return now }
+	return p, func(d time.Duration) { now = start.Add(d) }
+}
+
+func Test_progressRender(t *testing.T) {
+	tests := []struct {
+		withSize bool
+		want     []string
+	}{
+		{
+			withSize: true,
+			want: []string{
+				"\r\033[Kfiles: 0/2+, processed: 0.50 MB, 0.50 MB/s, ETA: 3s+",
+				"\r\033[Kfiles: 2/2, processed: 2.00 MB, 1.00 MB/s, ETA: 0s",
+				"\r\033[Kfiles: 2/2, processed: 2.00 MB, 1.00 MB/s, ETA: 0s\n",
+			},
+		},
+		{
+			withSize: false,
+			want: []string{
+				"\r\033[Kfiles: 0/2+, processed: 0.50 MB, 0.50 MB/s",
+				"\r\033[Kfiles: 2/2, processed: 2.00 MB, 1.00 MB/s",
+				"\r\033[Kfiles: 2/2, processed: 2.00 MB, 1.00 MB/s\n",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		p, setClock := testProgress(tt.withSize)
+		w := make(chanWriter)
+		ticks := make(chan time.Time)
+		stop, done := make(chan struct{}), make(chan struct{})
+		go p.render(w, ticks, stop, done)
+
+		var got []string
+		p.discovered(1_000_000)
+		p.discovered(1_000_000)
+		p.counted(Counts{Bytes: 500_000})
+		setClock(time.Second)
+		ticks <- time.Time{}
+		got = append(got, <-w)
+
+		p.walked()
+		p.fileDone()
+		p.fileDone()
+		p.counted(Counts{Bytes: 1_500_000})
+		setClock(2 * time.Second)
+		ticks <- time.Time{}
+		got = append(got, <-w)
+
+		close(stop)
+		got = append(got, <-w)
+		<-done
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("withSize %v: rendered %q, want %q", tt.withSize, got, tt.want)
+		}
+	}
+}
+
+func Test_progressDump(t *testing.T) {
+	p, setClock := testProgress(false)
+	p.discovered(0)
+	p.discovered(0)
+	p.fileDone()
+	p.counted(Counts{Lines: 3, Words: 4, Runes: 5, Bytes: 6})
+	setClock(1500 * time.Millisecond)
+
+	want := "partial totals: files: 1/2, lines: 3, words: 4, runes: 5, bytes: 6, elapsed: 1.5s"
+	if got := p.dump(); got != want {
+		t.Errorf("dump() = %q, want %q", got, want)
+	}
+}
+
+// sourceFiles is the content of every archive and directory source in the source tests
+var sourceFiles = map[string]string{
+	"a.txt":     "one two\n",
+	"dir/b.txt": "three\nfour five\n",
+}
+
+func writeZip(t *testing.T, name string, files map[string]string) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for path, data := range files {
+		w, err := zw.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTar(t *testing.T, name string, files map[string]string, gzipped bool) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	if gzipped {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for path, data := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: path, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeDir(t *testing.T, dir string, files map[string]string) {
+	for path, data := range files {
+		name := filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_openSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		create  func(t *testing.T, name string)
+		wantErr bool
+	}{
+		{"dir", func(t *testing.T, name string) { writeDir(t, name, sourceFiles) }, false},
+		{"src.zip", func(t *testing.T, name string) { writeZip(t, name, sourceFiles) }, false},
+		{"src.tar", func(t *testing.T, name string) { writeTar(t, name, sourceFiles, false) }, false},
+		{"src.tar.gz", func(t *testing.T, name string) { writeTar(t, name, sourceFiles, true) }, false},
+		{"SRC.TGZ", func(t *testing.T, name string) { writeTar(t, name, sourceFiles, true) }, false},
+		{"src.rar", func(t *testing.T, name string) { os.WriteFile(name, []byte("rar"), 0o644) }, true},
+		{"gzip.tgz", func(t *testing.T, name string) { os.WriteFile(name, []byte("not gzip"), 0o644) }, true},
+		{"escape.tar", func(t *testing.T, name string) { writeTar(t, name, map[string]string{"../escape.txt": "x"}, false) }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), tt.name)
+			tt.create(t, name)
+
+			src, err := openSource(name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("openSource() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			for path, want := range sourceFiles {
+				if got, err := fs.ReadFile(src.fs, path); err != nil || string(got) != want {
+					t.Errorf("ReadFile(%q) = %q, %v, want %q", path, got, err, want)
+				}
+			}
+			// workers of the multi-process mode open the root on their own
+			root, err := openSource(src.root)
+			if err != nil {
+				t.Fatalf("open root: %v", err)
+			}
+			if got, err := fs.ReadFile(root.fs, "a.txt"); err != nil || string(got) != sourceFiles["a.txt"] {
+				t.Errorf("ReadFile(root, a.txt) = %q, %v", got, err)
+			}
+			closeSources([]source{root, src})
+
+			if _, err := os.Stat(src.root); src.root != name && !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("extracted files %q are not removed: %v", src.root, err)
+			}
+		})
+	}
+}
+
+func Test_countSources(t *testing.T) {
+	dir := t.TempDir()
+	writeDir(t, filepath.Join(dir, "docs"), sourceFiles)
+	writeTar(t, filepath.Join(dir, "more.tgz"), map[string]string{"c.txt": "six seven eight\n"}, true)
+
+	tests := []struct {
+		name         string
+		sources      []string
+		wantPaths    []string
+		wantBySource []SourceCounts
+	}{
+		{
+			name:         "single source",
+			sources:      []string{"docs"},
+			wantPaths:    []string{"a.txt", "dir/b.txt"},
+			wantBySource: []SourceCounts{{Source: "docs", Files: 2, Counts: Counts{Lines: 3, Words: 5, Runes: 24, Bytes: 24}}},
+		},
+		{
+			name:      "many sources",
+			sources:   []string{"docs", "more.tgz"},
+			wantPaths: []string{"docs/a.txt", "docs/dir/b.txt", "more.tgz/c.txt"},
+			wantBySource: []SourceCounts{
+				{Source: "docs", Files: 2, Counts: Counts{Lines: 3, Words: 5, Runes: 24, Bytes: 24}},
+				{Source: "more.tgz", Files: 1, Counts: Counts{Lines: 1, Words: 3, Runes: 16, Bytes: 16}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var names []string
+			for _, name := range tt.sources {
+				names = append(names, filepath.Join(dir, name))
+			}
+			sources, err := openSources(names)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeSources(sources)
+
+			files, bySource, _, err := countSources(sources, calculateSequentially, &options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var paths []string
+			for _, file := range files {
+				paths = append(paths, strings.TrimPrefix(file.Path, dir+"/"))
+			}
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, tt.wantPaths) {
+				t.Errorf("paths %q, want %q", paths, tt.wantPaths)
+			}
+			for i := range bySource {
+				bySource[i].Source = strings.TrimPrefix(bySource[i].Source, dir+"/")
+			}
+			if !reflect.DeepEqual(bySource, tt.wantBySource) {
+				t.Errorf("by source %+v, want %+v", bySource, tt.wantBySource)
+			}
+		})
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// workerInflight is the amount of paths sent to a worker process before it reports the first of them
+	workerInflight = 8
+	// workerAttempts is the amount of worker crashes a single path may cause before it is given up
+	workerAttempts = 3
+	// workerTaskTimeout is how long a worker process may work on a single path before it is killed as hung
+	workerTaskTimeout = time.Minute
+)
+
+var errNoSourcePath = errors.New("source path is required to start worker processes")
+
+// errWorkersFailed stops the walk when a supervisor gives up, so the walker is not left blocked on sending paths
+var errWorkersFailed = errors.New("worker processes failed")
+
+// workerRequest is a line written to the stdin of a worker process
+type workerRequest struct {
+	Path string `json:"path"`
+}
+
+// workerResponse is a line written by a worker process to its stdout for every received path
+type workerResponse struct {
+	FileCounts
+	Skipped string         `json:"skipped,omitempty"`
+	Error   string         `json:"error,omitempty"`
+	Freq    map[string]int `json:"freq,omitempty"`
+}
+
+func calculateMultiProcess(f fs.FS, opts *options) ([]FileCounts, error) {
+	// Re-execute the binary as worker processes, the current process only walks the tree,
+	// sends paths to the workers and collects their responses
+	if opts.root == "" {
+		return nil, errNoSourcePath
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("find executable: %w", err)
+	}
+
+	return runSupervisors(f, opts, workerArgs(exe, opts), workerTaskTimeout)
+}
+
+// runSupervisors runs opts.workerCount() worker processes started with args and distributes the files of f among them.
+// A process which does not answer for timeout is killed and restarted.
+func runSupervisors(f fs.FS, opts *options, args []string, timeout time.Duration) ([]FileCounts, error) {
+	tasks := make(chan string)
+	responses := make(chan workerResponse)
+	errs := make(chan error, opts.workerCount())
+	failed := make(chan struct{})
+	var failOnce sync.Once
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.workerCount(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := &supervisor{args: args, timeout: timeout, attempts: map[string]int{}}
+			if err := s.run(tasks, responses); err != nil {
+				errs <- err
+				failOnce.Do(func() { close(failed) })
+			}
+		}()
+	}
+
+	walkErr := make(chan error, 1)
+	go func() {
+		walkErr <- traverseThroughAllFiles(f, opts, func(f fs.FS, path string) error {
+			select {
+			case tasks <- path:
+				return nil
+			case <-failed:
+				return errWorkersFailed
+			}
+		})
+		close(tasks)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(responses)
+		close(errs)
+	}()
+
+	var files []FileCounts
+	for resp := range responses {
+		opts.progress.fileDone()
+		switch {
+		case resp.Skipped != "":
+			opts.skip(resp.Path, resp.Skipped)
+		case resp.Error != "":
+			log.Printf("count words in %q: %s", resp.Path, resp.Error)
+		default:
+			opts.progress.counted(resp.Counts)
+			opts.freq.merge(resp.Freq)
+			files = append(files, resp.FileCounts)
+		}
+	}
+
+	// the walk is over by now: either all paths are sent or it is stopped by a failed supervisor
+	err := <-walkErr
+	for err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, err
+}
+
+func workerArgs(exe string, opts *options) []string {
+	return []string{
+		exe, "-worker",
+		"-path", opts.root,
+		"-skip-binary=" + strconv.FormatBool(opts.filter.skipBinary),
+		"-tokenizer=" + opts.tokenizerName(),
+		"-worker-freq=" + strconv.FormatBool(opts.freq != nil),
+	}
+}
+
+// supervisor runs a single worker process at a time and restarts it if it crashes or hangs.
+// Paths sent to the failed process and not reported yet are sent again to the restarted one.
+type supervisor struct {
+	args []string
+	// timeout is how long the process may work on a single path
+	timeout  time.Duration
+	attempts map[string]int
+	pending  []string
+}
+
+func (s *supervisor) run(tasks <-chan string, responses chan<- workerResponse) error {
+	for {
+		crashed, err := s.runProcess(tasks, responses)
+		if err != nil {
+			return err
+		}
+		if !crashed {
+			return nil
+		}
+	}
+}
+
+// runProcess starts a worker process and feeds it with paths until tasks are closed or the process dies.
+// The process is killed if it does not answer for s.timeout. It reports whether the process crashed or was killed,
+// the paths it has not reported are left in s.pending.
+func (s *supervisor) runProcess(tasks <-chan string, responses chan<- workerResponse) (crashed bool, err error) {
+	cmd := exec.Command(s.args[0], s.args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return false, fmt.Errorf("worker stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return false, fmt.Errorf("worker stdout: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return false, fmt.Errorf("start worker: %w", err)
+	}
+
+	var mu sync.Mutex
+	// inflight are the sent paths in the order they are sent, the worker answers them one by one in the same order
+	var inflight []string
+	// answered is when the worker reported a path or got a path while idle, the first path in flight is timed from it
+	var answered time.Time
+	var timedOut bool
+	slots := make(chan struct{}, workerInflight)
+	dead := make(chan struct{})
+	var leftover []string
+
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		defer stdin.Close()
+
+		enc := json.NewEncoder(stdin)
+		for {
+			path, ok := s.next(tasks, dead)
+			if !ok {
+				return
+			}
+
+			select {
+			case slots <- struct{}{}:
+			case <-dead:
+				leftover = append(leftover, path)
+				return
+			}
+
+			mu.Lock()
+			if len(inflight) == 0 {
+				answered = time.Now()
+			}
+			inflight = append(inflight, path)
+			mu.Unlock()
+
+			// the process is dead, the path is still in flight and will be sent again
+			if err := enc.Encode(workerRequest{Path: path}); err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(s.timeout / 4)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-dead:
+				return
+			case <-ticker.C:
+				mu.Lock()
+				hung := len(inflight) > 0 && time.Since(answered) > s.timeout
+				if hung {
+					timedOut = true
+					log.Printf("count words in %q: worker did not answer in %s, killing it", inflight[0], s.timeout)
+				}
+				mu.Unlock()
+
+				if hung {
+					cmd.Process.Kill()
+					return
+				}
+			}
+		}
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(stdout))
+	for {
+		var resp workerResponse
+		if err := dec.Decode(&resp); err != nil {
+			if !errors.Is(err, io.EOF) {
+				// the stream can not be resynchronised, the paths in flight are sent to a new process
+				log.Printf("read worker response: %v, killing the worker", err)
+				cmd.Process.Kill()
+			}
+			break
+		}
+
+		mu.Lock()
+		found := false
+		for i, path := range inflight {
+			if path == resp.Path {
+				inflight = append(inflight[:i], inflight[i+1:]...)
+				found = true
+				break
+			}
+		}
+		answered = time.Now()
+		mu.Unlock()
+		if !found {
+			log.Printf("unexpected worker response for %q, killing the worker", resp.Path)
+			cmd.Process.Kill()
+			break
+		}
+		<-slots
+
+		responses <- resp
+	}
+
+	// drain the pipe, the process is dead or has closed its stdout already, so the copy does not block
+	io.Copy(io.Discard, stdout)
+	waitErr := cmd.Wait()
+	close(dead)
+	<-writerDone
+
+	mu.Lock()
+	unfinished, killed := inflight, timedOut
+	mu.Unlock()
+
+	if len(unfinished) == 0 && len(leftover) == 0 {
+		if waitErr != nil {
+			log.Printf("worker exited: %v", waitErr)
+		}
+		return false, nil
+	}
+
+	if len(unfinished) == 0 {
+		return false, fmt.Errorf("worker exited before receiving any path: %v", waitErr)
+	}
+
+	// only the first path in flight is the one the worker was busy with, the rest are sent again without an attempt
+	path := unfinished[0]
+	reason := "worker crashed"
+	if killed {
+		reason = "worker timed out"
+	}
+	log.Printf("%s on %q with %d unfinished paths: %v, restarting", reason, path, len(unfinished), waitErr)
+
+	s.attempts[path]++
+	retry := unfinished
+	if s.attempts[path] >= workerAttempts {
+		log.Printf("count words in %q: %s %d times, giving up", path, reason, s.attempts[path])
+		responses <- workerResponse{FileCounts: FileCounts{Path: path}, Error: reason}
+		retry = unfinished[1:]
+	}
+	s.pending = append(s.pending, retry...)
+	s.pending = append(s.pending, leftover...)
+
+	return true, nil
+}
+
+// next returns the path to send, the paths left from the crashed process go first
+func (s *supervisor) next(tasks <-chan string, dead <-chan struct{}) (string, bool) {
+	if len(s.pending) > 0 {
+		path := s.pending[0]
+		s.pending = s.pending[1:]
+		return path, true
+	}
+
+	select {
+	case path, ok := <-tasks:
+		return path, ok
+	case <-dead:
+		return "", false
+	}
+}
+
+// runWorker reads paths from in and writes counts of every file to out, one JSON document per line.
+// It is executed in a child process started by the multi-process mode.
+// Only the filter and the tokenizer of opts are used, the rest of the settings are applied by the parent process.
+func runWorker(in io.Reader, out io.Writer, f fs.FS, opts *options, freq bool) error {
+	scanner := bufio.NewScanner(in)
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+
+	for scanner.Scan() {
+		var req workerRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return fmt.Errorf("parse request: %w", err)
+		}
+
+		var sink localFreq
+		if freq {
+			sink = localFreq{}
+		}
+
+		file, err := countFile(f, req.Path, opts.filter.skipBinary, opts.newTokenizer(sinkOrNil(sink)))
+		resp := workerResponse{FileCounts: file}
+		resp.Path = req.Path
+
+		var skip skipError
+		switch {
+		case errors.As(err, &skip):
+			resp.Skipped = skip.reason
+		case err != nil:
+			resp.Error = err.Error()
+		default:
+			// words of a file which failed halfway are not reported
+			resp.Freq = sink
+		}
+
+		if err := enc.Encode(resp); err != nil {
+			return fmt.Errorf("write response: %w", err)
+		}
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("write response: %w", err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// sinkOrNil converts nil map to nil interface, so wordCounter does not collect words if frequencies are disabled
+func sinkOrNil(sink localFreq) wordSink {
+	if sink == nil {
+		return nil
+	}
+	return sink
+}
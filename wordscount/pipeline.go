@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+type fileContent struct {
+	path  string
+	data  []byte
+	start time.Time
+}
+
+func calculatePipeline(f fs.FS, opts *options) ([]FileCounts, error) {
+	// Connect the walker, a pool of readers and a pool of counters with buffered channels,
+	// so reading the next files overlaps with counting the previous ones.
+	// The buffers bound the amount of file contents kept in memory at once.
+	workers := opts.workerCount()
+	paths := make(chan string, workers)
+	contents := make(chan fileContent, workers)
+	results := make(chan FileCounts, workers)
+	walkErr := make(chan error, 1)
+
+	go func() {
+		walkErr <- traverseThroughAllFiles(f, opts, func(f fs.FS, path string) error {
+			paths <- path
+			return nil
+		})
+		close(paths)
+	}()
+
+	var readers sync.WaitGroup
+	readers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer readers.Done()
+			for path := range paths {
+				content, err := readFile(f, path, opts.filter.skipBinary)
+				if err != nil {
+					opts.reject(path, err)
+					opts.progress.fileDone()
+					continue
+				}
+				contents <- content
+			}
+		}()
+	}
+
+	go func() {
+		readers.Wait()
+		close(contents)
+	}()
+
+	var counters sync.WaitGroup
+	counters.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer counters.Done()
+			sink := opts.freq.sink()
+			defer opts.freq.release(sink)
+
+			for content := range contents {
+				wc := wordCounter{tokens: opts.newTokenizer(sink)}
+				wc.Write(content.data)
+				wc.flush()
+
+				opts.progress.counted(wc.counts)
+				opts.progress.fileDone()
+				results <- FileCounts{Path: content.path, Counts: wc.counts, Duration: time.Since(content.start)}
+			}
+		}()
+	}
+
+	go func() {
+		counters.Wait()
+		close(results)
+	}()
+
+	var files []FileCounts
+	for file := range results {
+		files = append(files, file)
+	}
+
+	return files, <-walkErr
+}
+
+// readFile reads the whole file. If skipBinary is set and the file content is binary skipError is returned.
+func readFile(f fs.FS, path string, skipBinary bool) (fileContent, error) {
+	start := time.Now()
+
+	file, err := f.Open(path)
+	if err != nil {
+		return fileContent{}, fmt.Errorf("open file: %w", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return fileContent{}, fmt.Errorf("read file: %w", err)
+	}
+
+	head := data
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	if skipBinary && isBinary(head) {
+		return fileContent{}, skipError{reason: reasonBinary}
+	}
+
+	return fileContent{path: path, data: data, start: start}, nil
+}
+
+func calculateErrgroup(f fs.FS, opts *options) ([]FileCounts, error) {
+	// Same as limited-parallel, but errgroup.Group limits the amount of active goroutines instead of a fixed worker pool
+	var g errgroup.Group
+	g.SetLimit(opts.workerCount())
+
+	var mu sync.Mutex
+	var files []FileCounts
+
+	err := traverseThroughAllFiles(f, opts, func(f fs.FS, path string) error {
+		g.Go(func() error {
+			sink := opts.freq.sink()
+			defer opts.freq.release(sink)
+
+			file, ok := opts.countFile(f, path, sink)
+			if !ok {
+				return nil
+			}
+
+			mu.Lock()
+			files = append(files, file)
+			mu.Unlock()
+			return nil
+		})
+		return nil
+	})
+
+	g.Wait()
+	return files, err
+}
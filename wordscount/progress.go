@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// progress tracks the state of a run, it is updated concurrently by the walker and the workers.
+// All methods are safe to call on a nil *progress, so CountMethods do not need to check whether progress is tracked.
+type progress struct {
+	start    time.Time
+	withSize bool
+	// now is time.Now, tests replace it
+	now func() time.Time
+
+	discoveredFiles atomic.Int64
+	discoveredBytes atomic.Int64
+	doneFiles       atomic.Int64
+	pendingWalks    atomic.Int64
+
+	lines atomic.Int64
+	words atomic.Int64
+	runes atomic.Int64
+	bytes atomic.Int64
+}
+
+// newProgress creates progress tracker for the given amount of walks, one per source.
+// If withSize is set the size of every discovered file is tracked to estimate ETA.
+func newProgress(withSize bool, walks int) *progress {
+	p := &progress{start: time.Now(), withSize: withSize, now: time.Now}
+	p.pendingWalks.Store(int64(walks))
+	return p
+}
+
+func (p *progress) tracksSize() bool {
+	return p != nil && p.withSize
+}
+
+func (p *progress) discovered(size int64) {
+	if p == nil {
+		return
+	}
+	p.discoveredFiles.Add(1)
+	p.discoveredBytes.Add(size)
+}
+
+func (p *progress) walked() {
+	if p == nil {
+		return
+	}
+	p.pendingWalks.Add(-1)
+}
+
+// counted adds counts of a file or a part of a file to the partial totals
+func (p *progress) counted(c Counts) {
+	if p == nil {
+		return
+	}
+	p.lines.Add(int64(c.Lines))
+	p.words.Add(int64(c.Words))
+	p.runes.Add(int64(c.Runes))
+	p.bytes.Add(int64(c.Bytes))
+}
+
+func (p *progress) fileDone() {
+	if p == nil {
+		return
+	}
+	p.doneFiles.Add(1)
+}
+
+func (p *progress) String() string {
+	elapsed := p.now().Sub(p.start)
+	done, discovered := p.doneFiles.Load(), p.discoveredFiles.Load()
+	processed := p.bytes.Load()
+	throughput := float64(processed) / 1e6 / elapsed.Seconds()
+
+	// while the walk is in progress more files can be discovered, so the numbers are only lower bounds
+	more := ""
+	if p.pendingWalks.Load() > 0 {
+		more = "+"
+	}
+
+	line := fmt.Sprintf("files: %d/%d%s, processed: %.2f MB, %.2f MB/s", done, discovered, more, float64(processed)/1e6, throughput)
+	if eta, ok := p.eta(elapsed); ok {
+		line += fmt.Sprintf(", ETA: %s%s", eta.Round(time.Second), more)
+	}
+	return line
+}
+
+// eta estimates the time to process the discovered files by the throughput so far
+func (p *progress) eta(elapsed time.Duration) (time.Duration, bool) {
+	processed := p.bytes.Load()
+	if !p.withSize || processed == 0 {
+		return 0, false
+	}
+
+	remaining := p.discoveredBytes.Load() - processed
+	if remaining < 0 {
+		remaining = 0
+	}
+	return time.Duration(float64(elapsed) * float64(remaining) / float64(processed)), true
+}
+
+// dump describes partial totals counted so far
+func (p *progress) dump() string {
+	return fmt.Sprintf("partial totals: files: %d/%d, lines: %d, words: %d, runes: %d, bytes: %d, elapsed: %s",
+		p.doneFiles.Load(), p.discoveredFiles.Load(),
+		p.lines.Load(), p.words.Load(), p.runes.Load(), p.bytes.Load(),
+		p.now().Sub(p.start).Round(time.Millisecond))
+}
+
+// render rewrites the progress line in w on every tick until stop is closed, then prints the final state
+func (p *progress) render(w io.Writer, ticks <-chan time.Time, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case <-stop:
+			fmt.Fprintf(w, "\r\033[K%s\n", p)
+			return
+		case <-ticks:
+			fmt.Fprintf(w, "\r\033[K%s", p)
+		}
+	}
+}
+
+// showProgress starts rendering progress to stderr and returns the function which stops it.
+// Nothing is rendered if stderr is not a terminal, so redirected output is not polluted with control sequences.
+func showProgress(p *progress) (stop func()) {
+	if !isTerminal(os.Stderr) {
+		return func() {}
+	}
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go p.render(os.Stderr, ticker.C, stopCh, done)
+
+	return func() {
+		close(stopCh)
+		<-done
+		ticker.Stop()
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var reportFormats = list{"text", "json", "csv"}
+
+type lessFunc func(a, b FileCounts) bool
+type SortKeys map[string]lessFunc
+
+func (s SortKeys) All() []string {
+	var keys []string
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortKeys order files by path alphabetically and by any of the counts from the biggest to the smallest
+var sortKeys = SortKeys{
+	"path":     func(a, b FileCounts) bool { return a.Path < b.Path },
+	"lines":    func(a, b FileCounts) bool { return a.Lines > b.Lines },
+	"words":    func(a, b FileCounts) bool { return a.Words > b.Words },
+	"runes":    func(a, b FileCounts) bool { return a.Runes > b.Runes },
+	"bytes":    func(a, b FileCounts) bool { return a.Bytes > b.Bytes },
+	"duration": func(a, b FileCounts) bool { return a.Duration > b.Duration },
+}
+
+type reportConfig struct {
+	format string
+	// sortBy is empty if -sort is not set, the files are sorted by path then
+	sortBy  string
+	top     int
+	columns columns
+}
+
+func (c reportConfig) validate() error {
+	if !reportFormats.contains(c.format) {
+		return fmt.Errorf("invalid format %q, allowed formats: %s", c.format, reportFormats)
+	}
+	if _, ok := sortKeys[c.sortBy]; !ok && c.sortBy != "" {
+		return fmt.Errorf("invalid sort key %q, allowed keys: %s", c.sortBy, sortKeys.All())
+	}
+	if c.top < 0 {
+		return fmt.Errorf("invalid top %d, must not be negative", c.top)
+	}
+	return nil
+}
+
+// perFile reports whether text report should contain a row for every file instead of a single total line,
+// sorting the files makes sense only for the rows
+func (c reportConfig) perFile() bool {
+	return c.columns.any() || c.top > 0 || c.sortBy != ""
+}
+
+// columns selects which of the Counts are printed, the same way as `wc -l -w -m -c` flags do
+type columns struct {
+	lines bool
+	words bool
+	runes bool
+	bytes bool
+}
+
+func (c columns) any() bool {
+	return c.lines || c.words || c.runes || c.bytes
+}
+
+func (c columns) format(counts Counts) string {
+	var fields []string
+	if c.lines {
+		fields = append(fields, strconv.Itoa(counts.Lines))
+	}
+	if c.words {
+		fields = append(fields, strconv.Itoa(counts.Words))
+	}
+	if c.runes {
+		fields = append(fields, strconv.Itoa(counts.Runes))
+	}
+	if c.bytes {
+		fields = append(fields, strconv.Itoa(counts.Bytes))
+	}
+	return strings.Join(fields, "\t")
+}
+
+type report struct {
+	Files []FileCounts `json:"files"`
+	Total Counts       `json:"total"`
+	// Duration is the wall time of the whole run, in the parallel modes it is less than the sum of the file durations
+	Duration time.Duration  `json:"duration_ns"`
+	Skipped  []SkippedFile  `json:"skipped"`
+	TopWords []Stat         `json:"top_words,omitempty"`
+	Sources  []SourceCounts `json:"sources,omitempty"`
+}
+
+// newReport sorts files and cuts the first cfg.top of them. The total is always calculated over all files.
+func newReport(files []FileCounts, skipped []SkippedFile, topWords []Stat, elapsed time.Duration, cfg reportConfig) report {
+	less := sortKeys["path"]
+	if cfg.sortBy != "" {
+		less = sortKeys[cfg.sortBy]
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if less(files[i], files[j]) {
+			return true
+		}
+		if less(files[j], files[i]) {
+			return false
+		}
+		return files[i].Path < files[j].Path
+	})
+
+	r := report{Files: files, Total: totalCounts(files), Duration: elapsed, Skipped: skipped, TopWords: topWords}
+	if cfg.top > 0 && cfg.top < len(files) {
+		r.Files = files[:cfg.top]
+	}
+	return r
+}
+
+// printReport prints the report in cfg.format
+func printReport(w io.Writer, r report, cfg reportConfig) error {
+	switch cfg.format {
+	case "json":
+		return printJSON(w, r)
+	case "csv":
+		return printCSV(w, r)
+	default:
+		return printText(w, r, cfg)
+	}
+}
+
+func printText(w io.Writer, r report, cfg reportConfig) error {
+	if !cfg.perFile() {
+		if _, err := fmt.Fprintf(w, "Total words count: %d\n", r.Total.Words); err != nil {
+			return err
+		}
+		if err := printSources(w, r.Sources, columns{words: true}); err != nil {
+			return err
+		}
+		if err := printSkipped(w, r.Skipped); err != nil {
+			return err
+		}
+		return printTopWords(w, r.TopWords)
+	}
+
+	c := cfg.columns
+	if !c.any() {
+		c = columns{words: true, bytes: true}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', tabwriter.AlignRight)
+	for _, file := range r.Files {
+		fmt.Fprintf(tw, "%s\t%s\t %s\n", c.format(file.Counts), file.Duration.Round(time.Microsecond), file.Path)
+	}
+	fmt.Fprintf(tw, "%s\t%s\t %s\n", c.format(r.Total), r.Duration.Round(time.Microsecond), "total")
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if err := printSources(w, r.Sources, c); err != nil {
+		return err
+	}
+	if err := printSkipped(w, r.Skipped); err != nil {
+		return err
+	}
+	return printTopWords(w, r.TopWords)
+}
+
+// printTopWords prints the most frequent words in the same `word: count` format as the files tool
+func printTopWords(w io.Writer, stats []Stat) error {
+	if len(stats) == 0 {
+		return nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Top words:\n")
+	for _, stat := range stats {
+		sb.WriteString(fmt.Sprintf("%s: %d\n", stat.Word, stat.Count))
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// printSources prints the amount of files and the selected counts of every source
+func printSources(w io.Writer, sources []SourceCounts, c columns) error {
+	if len(sources) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(w, "Totals by source:")
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', tabwriter.AlignRight)
+	for _, src := range sources {
+		fmt.Fprintf(tw, "%d files\t%s\t %s\n", src.Files, c.format(src.Counts), src.Source)
+	}
+	return tw.Flush()
+}
+
+// printSkipped prints the number of skipped files grouped by reason, e.g. `Skipped: 3 (binary: 2, hidden: 1)`
+func printSkipped(w io.Writer, skipped []SkippedFile) error {
+	if len(skipped) == 0 {
+		return nil
+	}
+
+	byReason := map[string]int{}
+	var reasons []string
+	for _, s := range skipped {
+		if byReason[s.Reason] == 0 {
+			reasons = append(reasons, s.Reason)
+		}
+		byReason[s.Reason]++
+	}
+	sort.Strings(reasons)
+
+	groups := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		groups = append(groups, fmt.Sprintf("%s: %d", reason, byReason[reason]))
+	}
+
+	_, err := fmt.Fprintf(w, "Skipped: %d (%s)\n", len(skipped), strings.Join(groups, ", "))
+	return err
+}
+
+func printJSON(w io.Writer, r report) error {
+	if r.Files == nil {
+		r.Files = []FileCounts{}
+	}
+	if r.Skipped == nil {
+		r.Skipped = []SkippedFile{}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// printCSV prints a row for every reported file, the total is left for the consumer to calculate
+func printCSV(w io.Writer, r report) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"path", "lines", "words", "runes", "bytes", "duration_ns"})
+	for _, file := range r.Files {
+		cw.Write([]string{
+			file.Path,
+			strconv.Itoa(file.Lines),
+			strconv.Itoa(file.Words),
+			strconv.Itoa(file.Runes),
+			strconv.Itoa(file.Bytes),
+			strconv.FormatInt(file.Duration.Nanoseconds(), 10),
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "io"
+
+// dumpOnSignal does nothing, SIGUSR1 is only available on unix systems
+func dumpOnSignal(w io.Writer, p *progress) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_dumpOnSignal(t *testing.T) {
+	p, setClock := testProgress(false)
+	p.counted(Counts{Lines: 1, Words: 2, Runes: 3, Bytes: 4})
+	setClock(time.Second)
+
+	w := make(chanWriter, 1)
+	stop := dumpOnSignal(w, p)
+	defer stop()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-w:
+		want := "\npartial totals: files: 0/0, lines: 1, words: 2, runes: 3, bytes: 4, elapsed: 1s\n"
+		if got != want {
+			t.Errorf("dump = %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dump after SIGUSR1")
+	}
+}
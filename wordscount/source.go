@@ -0,0 +1,171 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// paths is a repeatable flag value, every occurrence adds a source
+type paths []string
+
+func (p *paths) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *paths) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// source is a directory or an archive exposed as fs.FS
+type source struct {
+	name string
+	// root is the directory or the archive which worker processes of the multi-process mode open,
+	// a tar archive is extracted once and the workers read the extracted files
+	root   string
+	fs     fs.FS
+	closer io.Closer
+}
+
+// openSource opens a directory, a zip archive or a tar archive optionally compressed with gzip
+func openSource(name string) (source, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return source{}, err
+	}
+	if info.IsDir() {
+		return source{name: name, root: name, fs: os.DirFS(name)}, nil
+	}
+
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		r, err := zip.OpenReader(name)
+		if err != nil {
+			return source{}, fmt.Errorf("open zip: %w", err)
+		}
+		return source{name: name, root: name, fs: r, closer: r}, nil
+	case strings.HasSuffix(lower, ".tar"):
+		return openTar(name, false)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return openTar(name, true)
+	default:
+		return source{}, errors.New("unsupported source, must be a directory, .zip, .tar, .tar.gz or .tgz")
+	}
+}
+
+func openSources(names []string) ([]source, error) {
+	var sources []source
+	for _, name := range names {
+		src, err := openSource(name)
+		if err != nil {
+			closeSources(sources)
+			return nil, fmt.Errorf("open source %q: %w", name, err)
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+func closeSources(sources []source) {
+	for _, src := range sources {
+		if src.closer != nil {
+			src.closer.Close()
+		}
+	}
+}
+
+// openTar extracts regular files of the tar archive into a temporary directory, which is removed on close.
+// tar has no index and gzip stream can not be read at random offsets, so the archive is read through once
+// and the files are streamed to disk instead of being kept in memory.
+func openTar(name string, gzipped bool) (source, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return source{}, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return source{}, fmt.Errorf("open gzip: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	dir, err := os.MkdirTemp("", "wordscount-tar-")
+	if err != nil {
+		return source{}, err
+	}
+	if err := extractTar(r, dir); err != nil {
+		os.RemoveAll(dir)
+		return source{}, err
+	}
+	return source{name: name, root: dir, fs: os.DirFS(dir), closer: tempDir(dir)}, nil
+}
+
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read tar: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// the path is checked, so an entry like ../../etc/passwd can not be written outside of dir
+		p := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if !fs.ValidPath(p) || p == "." {
+			return fmt.Errorf("invalid path %q in tar", hdr.Name)
+		}
+		if err := extractFile(tr, filepath.Join(dir, filepath.FromSlash(p)), fs.FileMode(hdr.Mode).Perm()); err != nil {
+			return fmt.Errorf("extract %q from tar: %w", hdr.Name, err)
+		}
+	}
+}
+
+// extractFile writes r to the file, it is always readable, so it can be counted
+func extractFile(r io.Reader, name string, perm fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm|0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// tempDir removes the directory of an extracted archive on close
+type tempDir string
+
+func (d tempDir) Close() error {
+	return os.RemoveAll(string(d))
+}
+
+// SourceCounts is the total of a single source
+type SourceCounts struct {
+	Source string `json:"source"`
+	Files  int    `json:"files"`
+	Counts
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"sort"
+	"unicode"
+	"unicode/utf8"
+)
+
+const defaultTokenizer = "letters-and-digits"
+
+// tokenizer splits a stream of runes into words. It keeps the state of a single text,
+// so a new tokenizer is created for every file or chunk of a file.
+// Found words are lowercased and passed to the sink the tokenizer was created with, if it is not nil.
+type tokenizer interface {
+	// next consumes the next rune of the text and returns the amount of words completed by it
+	next(r rune) int
+	// flush completes the word left at the end of the text and returns the amount of completed words
+	flush() int
+}
+
+// Tokenizers maps -tokenizer values to the constructors of tokenizers
+type Tokenizers map[string]func(sink wordSink) tokenizer
+
+func (t Tokenizers) All() []string {
+	var names []string
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (t Tokenizers) IsAllowed(name string) bool {
+	_, ok := t[name]
+	return ok
+}
+
+var allowedTokenizers = Tokenizers{
+	// the same as wc: a word is a run of anything but whitespace
+	"whitespace": func(sink wordSink) tokenizer {
+		return &runTokenizer{isWord: isNotSpace, word: wordBuffer{sink: sink}}
+	},
+	"letters-and-digits": func(sink wordSink) tokenizer {
+		return &runTokenizer{isWord: isWordRune, word: wordBuffer{sink: sink}}
+	},
+	"identifier": func(sink wordSink) tokenizer {
+		return &identifierTokenizer{word: wordBuffer{sink: sink}}
+	},
+	"uax29": func(sink wordSink) tokenizer {
+		return &uax29Tokenizer{word: wordBuffer{sink: sink}}
+	},
+}
+
+// wordBuffer collects lowercased runes of the current word, but only if there is a sink to pass the word to
+type wordBuffer struct {
+	sink wordSink
+	buf  []byte
+}
+
+func (b *wordBuffer) add(r rune) {
+	if b.sink != nil {
+		b.buf = utf8.AppendRune(b.buf, unicode.ToLower(r))
+	}
+}
+
+// trim removes the last added rune r from the buffer
+func (b *wordBuffer) trim(r rune) {
+	if b.sink != nil {
+		b.buf = b.buf[:len(b.buf)-utf8.RuneLen(unicode.ToLower(r))]
+	}
+}
+
+func (b *wordBuffer) emit() int {
+	if b.sink != nil {
+		b.sink.add(b.buf)
+		b.buf = b.buf[:0]
+	}
+	return 1
+}
+
+func (b *wordBuffer) reset() {
+	b.buf = b.buf[:0]
+}
+
+// runTokenizer treats every maximal run of runes matching isWord as a word
+type runTokenizer struct {
+	isWord func(r rune) bool
+	inWord bool
+	word   wordBuffer
+}
+
+func (t *runTokenizer) next(r rune) int {
+	if t.isWord(r) {
+		t.inWord = true
+		t.word.add(r)
+		return 0
+	}
+	return t.flush()
+}
+
+func (t *runTokenizer) flush() int {
+	if !t.inWord {
+		return 0
+	}
+	t.inWord = false
+	return t.word.emit()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+func isNotSpace(r rune) bool {
+	return !unicode.IsSpace(r)
+}
+
+// identifierTokenizer splits runs of letters and digits into the parts of camelCase and PascalCase identifiers:
+// a new word starts at an upper case letter following a lower case letter or a digit, and at the last upper case
+// letter of an acronym followed by a lower case letter, e.g. parseHTTPServer2Config is parse, http, server2, config.
+// Any other rune separates words, so snake_case and kebab-case are split as well.
+type identifierTokenizer struct {
+	inWord bool
+	// upperRun is the amount of upper case letters at the end of the current word
+	upperRun int
+	last     rune
+	word     wordBuffer
+}
+
+func (t *identifierTokenizer) next(r rune) int {
+	if !isWordRune(r) {
+		return t.flush()
+	}
+	if !t.inWord {
+		t.start(r)
+		return 0
+	}
+
+	upper := unicode.IsUpper(r)
+	switch {
+	case upper && t.upperRun == 0:
+		// fooBar, foo2Bar
+		words := t.word.emit()
+		t.start(r)
+		return words
+	case !upper && unicode.IsLetter(r) && t.upperRun > 1:
+		// HTTPServer: the last upper case letter of the acronym starts the next word
+		last := t.last
+		t.word.trim(last)
+		words := t.word.emit()
+		t.start(last)
+		t.add(r)
+		t.upperRun = 0
+		return words
+	}
+
+	t.add(r)
+	if upper {
+		t.upperRun++
+	} else {
+		t.upperRun = 0
+	}
+	return 0
+}
+
+func (t *identifierTokenizer) start(r rune) {
+	t.inWord = true
+	t.upperRun = 0
+	if unicode.IsUpper(r) {
+		t.upperRun = 1
+	}
+	t.add(r)
+}
+
+func (t *identifierTokenizer) add(r rune) {
+	t.word.add(r)
+	t.last = r
+}
+
+func (t *identifierTokenizer) flush() int {
+	if !t.inWord {
+		return 0
+	}
+	t.inWord = false
+	t.upperRun = 0
+	return t.word.emit()
+}
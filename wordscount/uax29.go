@@ -0,0 +1,96 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+)
+
+// uax29MaxRun is the length of a run without whitespace after which uax29Tokenizer segments the run without
+// waiting for its end, so a huge file without whitespace is not collected in memory as a whole
+const uax29MaxRun = 64 << 10
+
+// uax29Tokenizer splits the text by the word boundaries of UAX #29 (https://unicode.org/reports/tr29/#Word_Boundaries)
+// using the Word_Break tables of github.com/rivo/uniseg. Like in ICU only the segments containing letters or digits
+// are words, punctuation, spaces and emoji are skipped.
+//
+// A boundary may depend on the runes after it, e.g. whether "can't" or "3.14" continue after the punctuation,
+// so the runes are collected up to ASCII whitespace, which always ends a word, and the run is segmented at once.
+type uax29Tokenizer struct {
+	word wordBuffer
+	run  []byte
+	// limit is the length of the run to segment it, it grows if the run can not be cut, so it is not segmented for every rune
+	limit int
+}
+
+func (t *uax29Tokenizer) next(r rune) int {
+	switch r {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return t.flush()
+	}
+
+	t.run = utf8.AppendRune(t.run, r)
+	if len(t.run) >= uax29MaxRun && len(t.run) >= t.limit {
+		words := t.segment(false)
+		t.limit = 2 * len(t.run)
+		return words
+	}
+	return 0
+}
+
+func (t *uax29Tokenizer) flush() int {
+	t.limit = 0
+	return t.segment(true)
+}
+
+// segment counts the words of the collected run. If the run is not complete, its last two segments are kept:
+// the next runes may join them, e.g. "3." and "14".
+func (t *uax29Tokenizer) segment(complete bool) int {
+	var words int
+	var segments [][]byte
+	rest, state := t.run, -1
+	for len(rest) > 0 {
+		var segment []byte
+		segment, rest, state = uniseg.FirstWord(rest, state)
+		segments = append(segments, segment)
+	}
+
+	keep := 0
+	if !complete && len(segments) > 2 {
+		keep = 2
+	} else if !complete {
+		// too few segments to decide, wait for more runes
+		return 0
+	}
+
+	for _, segment := range segments[:len(segments)-keep] {
+		words += t.count(segment)
+	}
+
+	kept := len(t.run)
+	for _, segment := range segments[len(segments)-keep:] {
+		kept -= len(segment)
+	}
+	t.run = t.run[:copy(t.run, t.run[kept:])]
+	return words
+}
+
+// count returns 1 if the segment is a word, i.e. it has a letter or a digit
+func (t *uax29Tokenizer) count(segment []byte) int {
+	var isWord bool
+	for _, r := range string(segment) {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			isWord = true
+			break
+		}
+	}
+	if !isWord {
+		return 0
+	}
+
+	for _, r := range string(segment) {
+		t.word.add(r)
+	}
+	return t.word.emit()
+}